@@ -0,0 +1,286 @@
+package necl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// registerCollectionFunctions adds the functions that work on arrays and maps
+// length and contains also work on strings
+func registerCollectionFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "length",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case string:
+				return utf8.RuneCountInString(v), nil
+			case []interface{}:
+				return len(v), nil
+			case map[string]interface{}:
+				return len(v), nil
+			}
+			err := fmt.Errorf("can't get the length of a %s", typeOfValue(args[0]))
+			return nil, &ArgumentError{Index: 0, Err: err}
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "contains",
+		Parameters: []Parameter{{Name: "collection", Type: TypeAny}, {Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch c := args[0].(type) {
+			case string:
+				substring, ok := args[1].(string)
+				if !ok {
+					err := fmt.Errorf("only strings can be searched in a string, got %s", typeOfValue(args[1]))
+					return nil, &ArgumentError{Index: 1, Err: err}
+				}
+				return strings.Contains(c, substring), nil
+			case []interface{}:
+				return membership(args[1], c)
+			}
+			err := fmt.Errorf("can only search in a string or an array, got %s", typeOfValue(args[0]))
+			return nil, &ArgumentError{Index: 0, Err: err}
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "keys",
+		Parameters: []Parameter{{Name: "map", Type: TypeMap}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			keys, _, _ := collectionElements(args[0])
+			return append([]interface{}{}, keys...), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "values",
+		Parameters: []Parameter{{Name: "map", Type: TypeMap}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			_, values, _ := collectionElements(args[0])
+			return append([]interface{}{}, values...), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:     "merge",
+		Variadic: &Parameter{Name: "maps", Type: TypeMap},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			merged := map[string]interface{}{}
+			for _, arg := range args {
+				for key, value := range arg.(map[string]interface{}) {
+					merged[key] = value
+				}
+			}
+			return merged, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "flatten",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return flatten(args[0].([]interface{})), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "distinct",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			distinct := []interface{}{}
+			for _, element := range args[0].([]interface{}) {
+				found, _ := membership(element, distinct)
+				if !found {
+					distinct = append(distinct, element)
+				}
+			}
+			return distinct, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "sort",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return sortList(args[0].([]interface{}))
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "reverse",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			list := args[0].([]interface{})
+			reversed := make([]interface{}, len(list))
+			for i, element := range list {
+				reversed[len(list)-1-i] = element
+			}
+			return reversed, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "slice",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}, {Name: "start", Type: TypeNumber}, {Name: "end", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			list := args[0].([]interface{})
+			start, err := integerArgument(args[1], "start")
+			if err != nil {
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			end, err := integerArgument(args[2], "end")
+			if err != nil {
+				return nil, &ArgumentError{Index: 2, Err: err}
+			}
+			if start < 0 || start > len(list) {
+				err := fmt.Errorf("start %d out of range for length %d", start, len(list))
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			if end < start || end > len(list) {
+				err := fmt.Errorf("end %d out of range for start %d and length %d", end, start, len(list))
+				return nil, &ArgumentError{Index: 2, Err: err}
+			}
+			return append([]interface{}{}, list[start:end]...), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "element",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}, {Name: "index", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			list := args[0].([]interface{})
+			index, err := integerArgument(args[1], "index")
+			if err == nil && index < 0 {
+				err = fmt.Errorf("index can't be negative, got %d", index)
+			}
+			if err != nil {
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			if len(list) == 0 {
+				err := fmt.Errorf("can't get an element of an empty array")
+				return nil, &ArgumentError{Index: 0, Err: err}
+			}
+			// Indexes after the end wrap around
+			return list[index%len(list)], nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "index",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}, {Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			for i, element := range args[0].([]interface{}) {
+				if valuesEqual(element, args[1]) {
+					return i, nil
+				}
+			}
+			err := fmt.Errorf("value %v is not in the array", args[1])
+			return nil, &ArgumentError{Index: 1, Err: err}
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "lookup",
+		Parameters: []Parameter{{Name: "map", Type: TypeMap}, {Name: "key", Type: TypeString}, {Name: "default", Type: TypeAny, Optional: true}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			value, found := args[0].(map[string]interface{})[args[1].(string)]
+			if found {
+				return value, nil
+			}
+			if len(args) == 3 {
+				return args[2], nil
+			}
+			err := fmt.Errorf("no key %q in the map and no default value", args[1])
+			return nil, &ArgumentError{Index: 1, Err: err}
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "zipmap",
+		Parameters: []Parameter{{Name: "keys", Type: TypeArray}, {Name: "values", Type: TypeArray}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			keys := args[0].([]interface{})
+			values := args[1].([]interface{})
+			if len(keys) != len(values) {
+				err := fmt.Errorf("got %d keys and %d values", len(keys), len(values))
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			zipped := map[string]interface{}{}
+			for i, key := range keys {
+				name, ok := key.(string)
+				if !ok {
+					err := fmt.Errorf("keys must be strings, key %d is a %s", i, typeOfValue(key))
+					return nil, &ArgumentError{Index: 0, Err: err}
+				}
+				zipped[name] = values[i]
+			}
+			return zipped, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "setproduct",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}},
+		Variadic:   &Parameter{Name: "lists", Type: TypeArray},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			product := []interface{}{[]interface{}{}}
+			for _, arg := range args {
+				var next []interface{}
+				for _, combination := range product {
+					for _, element := range arg.([]interface{}) {
+						extended := append(append([]interface{}{}, combination.([]interface{})...), element)
+						next = append(next, extended)
+					}
+				}
+				product = next
+			}
+			if product == nil {
+				product = []interface{}{}
+			}
+			return product, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "chunklist",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}, {Name: "size", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			list := args[0].([]interface{})
+			size, err := integerArgument(args[1], "size")
+			if err == nil && size <= 0 {
+				err = fmt.Errorf("size must be positive, got %d", size)
+			}
+			if err != nil {
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			chunks := []interface{}{}
+			for start := 0; start < len(list); start += size {
+				end := start + size
+				if end > len(list) {
+					end = len(list)
+				}
+				chunks = append(chunks, append([]interface{}{}, list[start:end]...))
+			}
+			return chunks, nil
+		},
+	})
+}
+
+// flatten replaces the arrays inside an array with their elements, at any depth
+func flatten(list []interface{}) []interface{} {
+	flat := []interface{}{}
+	for _, element := range list {
+		if nested, ok := element.([]interface{}); ok {
+			flat = append(flat, flatten(nested)...)
+			continue
+		}
+		flat = append(flat, element)
+	}
+	return flat
+}
+
+// sortList sorts an array of strings or an array of numbers
+func sortList(list []interface{}) (interface{}, error) {
+	sorted := append([]interface{}{}, list...)
+	for i, element := range sorted {
+		if typeOfValue(element) != typeOfValue(sorted[0]) || (typeOfValue(element) != TypeString && typeOfValue(element) != TypeNumber) {
+			err := fmt.Errorf("only arrays of strings or of numbers can be sorted, element %d is a %s", i, typeOfValue(element))
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		less, _ := compareValues("<", sorted[i], sorted[j])
+		return less
+	})
+	return sorted, nil
+}
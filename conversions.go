@@ -0,0 +1,110 @@
+package necl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// registerConversionFunctions adds the functions that convert values from one type to another
+// Converting null gives null, except for tolist and tomap that give an empty collection
+func registerConversionFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "tostring",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			if args[0] == nil {
+				return nil, nil
+			}
+			text, ok := interpolatedText(args[0])
+			if !ok {
+				err := fmt.Errorf("can't convert a %s to a string", typeOfValue(args[0]))
+				return nil, err
+			}
+			return text, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "tonumber",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil, int, float64:
+				return v, nil
+			case string:
+				return parseNumber(v)
+			}
+			err := fmt.Errorf("can't convert a %s to a number", typeOfValue(args[0]))
+			return nil, err
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "tobool",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil, bool:
+				return v, nil
+			case string:
+				if v == "true" || v == "false" {
+					return v == "true", nil
+				}
+				err := fmt.Errorf("can't convert %q to a boolean, only \"true\" and \"false\" can", v)
+				return nil, err
+			}
+			err := fmt.Errorf("can't convert a %s to a boolean", typeOfValue(args[0]))
+			return nil, err
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "tolist",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil:
+				return []interface{}{}, nil
+			case []interface{}:
+				return v, nil
+			case map[string]interface{}:
+				err := fmt.Errorf("can't convert a map to an array, use keys or values")
+				return nil, err
+			}
+			// Single values become an array with one element
+			return []interface{}{args[0]}, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "tomap",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			switch v := args[0].(type) {
+			case nil:
+				return map[string]interface{}{}, nil
+			case map[string]interface{}:
+				return v, nil
+			}
+			err := fmt.Errorf("can't convert a %s to a map", typeOfValue(args[0]))
+			return nil, err
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "typeof",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return typeOfValue(args[0]), nil
+		},
+	})
+}
+
+// parseNumber converts a string to an integer or, if it has decimals, to a float
+func parseNumber(str string) (interface{}, error) {
+	if integer, err := strconv.Atoi(str); err == nil {
+		return integer, nil
+	}
+	number, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		err := fmt.Errorf("can't convert %q to a number", str)
+		return nil, err
+	}
+	return number, nil
+}
@@ -0,0 +1,195 @@
+package necl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// registerEncodingFunctions adds the functions that encode values to strings and decode them back
+// Decoded structures become NECL arrays and maps
+func registerEncodingFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "base64encode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return base64.StdEncoding.EncodeToString([]byte(args[0].(string))), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "base64decode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			decoded, err := base64.StdEncoding.DecodeString(args[0].(string))
+			if err != nil {
+				err := fmt.Errorf("invalid base64: %s", err)
+				return nil, err
+			}
+			if !utf8.Valid(decoded) {
+				err := fmt.Errorf("the decoded value is not valid UTF-8 text")
+				return nil, err
+			}
+			return string(decoded), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "jsonencode",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			encoded, err := json.Marshal(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return string(encoded), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "jsondecode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			decoder := json.NewDecoder(strings.NewReader(args[0].(string)))
+			decoder.UseNumber()
+			var value interface{}
+			err := decoder.Decode(&value)
+			if err == nil && decoder.More() {
+				err = fmt.Errorf("unexpected data after the value")
+			}
+			if err != nil {
+				err := fmt.Errorf("invalid JSON: %s", err)
+				return nil, err
+			}
+			return decodedValue(value)
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "yamlencode",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			var encoded bytes.Buffer
+			encoder := yaml.NewEncoder(&encoded)
+			encoder.SetIndent(2)
+			err := encoder.Encode(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return encoded.String(), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "yamldecode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			var value interface{}
+			err := yaml.Unmarshal([]byte(args[0].(string)), &value)
+			if err != nil {
+				err := fmt.Errorf("invalid YAML: %s", strings.TrimPrefix(err.Error(), "yaml: "))
+				return nil, err
+			}
+			return decodedValue(value)
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "urlencode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return url.QueryEscape(args[0].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "csvdecode",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return decodeCSV(args[0].(string))
+		},
+	})
+}
+
+// decodedValue converts a value decoded from JSON or YAML to a NECL value
+func decodedValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, int, float64:
+		return v, nil
+	case json.Number:
+		return parseNumber(v.String())
+	case int64, uint64:
+		return parseNumber(fmt.Sprint(v))
+	case []interface{}:
+		elements := []interface{}{}
+		for _, element := range v {
+			decoded, err := decodedValue(element)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, decoded)
+		}
+		return elements, nil
+	case map[string]interface{}:
+		values := map[string]interface{}{}
+		for key, element := range v {
+			decoded, err := decodedValue(element)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = decoded
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		values := map[string]interface{}{}
+		for key, element := range v {
+			text, ok := interpolatedText(key)
+			if !ok {
+				err := fmt.Errorf("map keys must be strings, numbers or booleans, got %v", key)
+				return nil, err
+			}
+			decoded, err := decodedValue(element)
+			if err != nil {
+				return nil, err
+			}
+			values[text] = decoded
+		}
+		return values, nil
+	}
+
+	err := fmt.Errorf("unsupported value %v of type %T", value, value)
+	return nil, err
+}
+
+// decodeCSV decodes CSV text with a header line into an array of maps, one per line, from the names of the columns to the values
+func decodeCSV(str string) (interface{}, error) {
+	reader := csv.NewReader(strings.NewReader(str))
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []interface{}{}, nil
+	}
+	if err != nil {
+		err := fmt.Errorf("invalid CSV: %s", err)
+		return nil, err
+	}
+
+	rows := []interface{}{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err := fmt.Errorf("invalid CSV: %s", err)
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,54 @@
+package necl
+
+import (
+	"fmt"
+	"os"
+)
+
+// envAccess has the settings of the function that reads environment variables
+type envAccess struct {
+	// Names of the variables that can be read, if nil only the variables of values can be read
+	allowed map[string]bool
+	// Variables used instead of the environment of the process, if not nil
+	values map[string]string
+}
+
+// registerEnvFunctions adds the functions that read environment variables
+func registerEnvFunctions(r *FunctionRegistry, access envAccess) {
+	r.mustRegister(Function{
+		Name:       "env",
+		Parameters: []Parameter{{Name: "name", Type: TypeString}, {Name: "default", Type: TypeAny, Optional: true}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			name := args[0].(string)
+			value, found, err := access.lookup(name)
+			if err != nil {
+				return nil, &ArgumentError{Index: 0, Err: err}
+			}
+			if found {
+				return value, nil
+			}
+			if len(args) == 2 {
+				return args[1], nil
+			}
+			err = fmt.Errorf("environment variable %s is not set and has no default value", name)
+			return nil, err
+		},
+	})
+
+	r.parseFunctions["env"] = true
+}
+
+// lookup gets the value of an environment variable, if it's allowed
+// The environment of the process is only read for allowed variables, so no variable can be read without settings
+func (a envAccess) lookup(name string) (string, bool, error) {
+	if (a.allowed == nil && a.values == nil) || (a.allowed != nil && !a.allowed[name]) {
+		err := fmt.Errorf("environment variable %s is not allowed", name)
+		return "", false, err
+	}
+	if a.values != nil {
+		value, found := a.values[name]
+		return value, found, nil
+	}
+	value, found := os.LookupEnv(name)
+	return value, found, nil
+}
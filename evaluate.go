@@ -0,0 +1,633 @@
+package necl
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// evaluator calculates the value of a parsed expression
+type evaluator struct {
+	expression string
+	names      names
+	// Functions that can be called, the built-in functions are used when it's nil
+	registry *FunctionRegistry
+	// Elements visited by the splats being evaluated, the innermost one is last
+	splatElements []interface{}
+	// Variables of the loops being evaluated, the innermost loop is last
+	locals []map[string]interface{}
+	// Number of calls to functions defined in the document around this evaluation
+	depth int
+}
+
+// names finds the attributes that an expression can use
+type names interface {
+	lookupName(name string) (Attribute, bool)
+}
+
+// attributeNames are the names of a fixed set of attributes
+type attributeNames map[string]Attribute
+
+func (a attributeNames) lookupName(name string) (Attribute, bool) {
+	attribute, ok := a[name]
+	return attribute, ok
+}
+
+// evaluateExpression parses and calculates the value of an expression, registry can be nil to use the built-in functions
+func evaluateExpression(expression string, names names, registry *FunctionRegistry) (interface{}, error) {
+	n, err := parseExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &evaluator{
+		expression: expression,
+		names:      names,
+		registry:   registry,
+	}
+
+	value, err := e.evaluate(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeValue(value), nil
+}
+
+// lookup finds the value of a name, loop variables shadow attributes with the same name
+func (e *evaluator) lookup(name string) (interface{}, bool) {
+	for i := len(e.locals) - 1; i >= 0; i-- {
+		if value, ok := e.locals[i][name]; ok {
+			return value, true
+		}
+	}
+
+	attribute, ok := e.names.lookupName(name)
+	if !ok {
+		return nil, false
+	}
+	return attributeToValue(attribute), true
+}
+
+// errorf creates an error pointing at the position of a node
+func (e *evaluator) errorf(n node, format string, args ...interface{}) error {
+	return positionError(e.expression, n.Position(), format, args...)
+}
+
+// evaluate calculates the value of a single node
+func (e *evaluator) evaluate(n node) (interface{}, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.Value, nil
+	case *referenceNode:
+		value, ok := e.lookup(n.Name)
+		if !ok {
+			return nil, e.errorf(n, "no attribute named %s was found", n.Name)
+		}
+		return value, nil
+	case *arrayNode:
+		array := []interface{}{}
+		for _, element := range n.Elements {
+			value, err := e.evaluate(element)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case *unaryNode:
+		value, err := e.evaluate(n.Operand)
+		if err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case int:
+			if n.Operator == "-" {
+				if v == math.MinInt {
+					return nil, e.errorf(n, "overflow, -(%d) is too large for an integer", v)
+				}
+				return -v, nil
+			}
+		case float64:
+			if n.Operator == "-" {
+				return -v, nil
+			}
+		case bool:
+			if n.Operator == "!" {
+				return !v, nil
+			}
+		}
+		return nil, e.errorf(n, "operator %s can't be applied to %s", n.Operator, typeOfValue(value))
+	case *binaryNode:
+		return e.evaluateBinary(n)
+	case *conditionalNode:
+		condition, err := e.evaluate(n.Condition)
+		if err != nil {
+			return nil, err
+		}
+		result, ok := condition.(bool)
+		if !ok {
+			return nil, e.errorf(n.Condition, "condition must be a boolean, got %s", typeOfValue(condition))
+		}
+		if result {
+			return e.evaluate(n.Positive)
+		}
+		return e.evaluate(n.Negative)
+	case *forNode:
+		return e.evaluateFor(n)
+	case *interpolationNode:
+		var result strings.Builder
+		for _, part := range n.Parts {
+			value, err := e.evaluate(part)
+			if err != nil {
+				return nil, err
+			}
+			text, ok := interpolatedText(value)
+			if !ok {
+				return nil, e.errorf(part, "%s values can't be interpolated in a string", typeOfValue(value))
+			}
+			result.WriteString(text)
+		}
+		return result.String(), nil
+	case *callNode:
+		if function, ok := userFunctionOf(n.Name, e.names); ok {
+			return e.callFunction(n, function)
+		}
+		function, ok := e.functions().lookup(n.Name)
+		if !ok {
+			return nil, e.errorf(n, "unknown function %s", n.Name)
+		}
+		return e.callRegisteredFunction(n, function)
+	case *indexNode:
+		return e.evaluateIndex(n)
+	case *sliceNode:
+		return e.evaluateSlice(n)
+	case *getAttributeNode:
+		value, err := e.evaluate(n.Collection)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := asMap(value)
+		if !ok {
+			return nil, e.errorf(n, "can't get attribute %s of a value of type %s", n.Name, typeOfValue(value))
+		}
+		attribute, ok := values[n.Name]
+		if !ok {
+			return nil, e.errorf(n, "no attribute named %s was found", n.Name)
+		}
+		return attribute, nil
+	case *splatNode:
+		return e.evaluateSplat(n)
+	case *splatElementNode:
+		return e.splatElements[len(e.splatElements)-1], nil
+	}
+
+	return nil, e.errorf(n, "unknown expression")
+}
+
+// evaluateBinary applies an operator to two values
+func (e *evaluator) evaluateBinary(n *binaryNode) (interface{}, error) {
+	left, err := e.evaluate(n.Left)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators only evaluate the right side when needed
+	if n.Operator == "&&" || n.Operator == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, e.errorf(n.Left, "operator %s requires booleans, got %s", n.Operator, typeOfValue(left))
+		}
+		if (n.Operator == "&&" && !l) || (n.Operator == "||" && l) {
+			return l, nil
+		}
+		right, err := e.evaluate(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, e.errorf(n.Right, "operator %s requires booleans, got %s", n.Operator, typeOfValue(right))
+		}
+		return r, nil
+	}
+
+	right, err := e.evaluate(n.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	switch n.Operator {
+	case "==":
+		result = valuesEqual(left, right)
+	case "!=":
+		result = !valuesEqual(left, right)
+	case "<", "<=", ">", ">=":
+		result, err = compareValues(n.Operator, left, right)
+	case "in":
+		result, err = membership(left, right)
+	case "..", "..=":
+		result, err = numberRange(left, right, n.Operator == "..=")
+	default:
+		result, err = arithmetic(n.Operator, left, right)
+	}
+	if err != nil {
+		return nil, e.errorf(n, "%s", err)
+	}
+
+	return result, nil
+}
+
+// evaluateFor creates an array or a map out of the elements of a collection
+func (e *evaluator) evaluateFor(n *forNode) (interface{}, error) {
+	collection, err := e.evaluate(n.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, elements, ok := collectionElements(collection)
+	if !ok {
+		return nil, e.errorf(n.Collection, "a 'for' expression requires an array or a map, got %s", typeOfValue(collection))
+	}
+
+	resultArray := []interface{}{}
+	resultMap := make(map[string]interface{})
+	for i, element := range elements {
+		// Loop variables are only visible inside the loop
+		locals := map[string]interface{}{n.ValueName: element}
+		if n.KeyName != "" {
+			locals[n.KeyName] = keys[i]
+		}
+		e.locals = append(e.locals, locals)
+		err := e.evaluateForElement(n, resultMap, &resultArray)
+		e.locals = e.locals[:len(e.locals)-1]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if n.Key != nil {
+		return resultMap, nil
+	}
+	return resultArray, nil
+}
+
+// collectionElements gets the keys and the elements of an array or a map
+// Arrays are visited in order with their indexes as keys, maps are visited in the order of their keys
+func collectionElements(collection interface{}) ([]interface{}, []interface{}, bool) {
+	var keys []interface{}
+	var elements []interface{}
+	switch c := collection.(type) {
+	case []interface{}:
+		for i, element := range c {
+			keys = append(keys, i)
+			elements = append(elements, element)
+		}
+	case map[string]interface{}, blockGroup:
+		values, _ := asMap(c)
+		for _, key := range sortedKeys(values) {
+			keys = append(keys, key)
+			elements = append(elements, values[key])
+		}
+	default:
+		return nil, nil, false
+	}
+	return keys, elements, true
+}
+
+// evaluateForElement adds the outcome of a single element of a "for" expression to the result
+func (e *evaluator) evaluateForElement(n *forNode, resultMap map[string]interface{}, resultArray *[]interface{}) error {
+	// Filter
+	if n.Filter != nil {
+		filter, err := e.evaluate(n.Filter)
+		if err != nil {
+			return err
+		}
+		include, ok := filter.(bool)
+		if !ok {
+			return e.errorf(n.Filter, "filter must be a boolean, got %s", typeOfValue(filter))
+		}
+		if !include {
+			return nil
+		}
+	}
+
+	value, err := e.evaluate(n.Value)
+	if err != nil {
+		return err
+	}
+
+	// Array
+	if n.Key == nil {
+		*resultArray = append(*resultArray, value)
+		return nil
+	}
+
+	// Map
+	key, err := e.evaluate(n.Key)
+	if err != nil {
+		return err
+	}
+	k, ok := key.(string)
+	if !ok {
+		return e.errorf(n.Key, "map keys must be strings, got %s", typeOfValue(key))
+	}
+	if _, exists := resultMap[k]; exists {
+		return e.errorf(n.Key, "duplicate key %q", k)
+	}
+	resultMap[k] = value
+
+	return nil
+}
+
+// evaluateIndex gets an element of an array, a character of a string or a value of a map
+func (e *evaluator) evaluateIndex(n *indexNode) (interface{}, error) {
+	collection, err := e.evaluate(n.Collection)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.evaluate(n.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := collection.(type) {
+	case []interface{}:
+		i, err := e.position(n.Key, key, len(c))
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(c) {
+			return nil, e.errorf(n.Key, "index %v out of range for array of length %d", key, len(c))
+		}
+		return c[i], nil
+	case string:
+		characters := []rune(c)
+		i, err := e.position(n.Key, key, len(characters))
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(characters) {
+			return nil, e.errorf(n.Key, "index %v out of range for string of length %d", key, len(characters))
+		}
+		return string(characters[i]), nil
+	case map[string]interface{}, blockGroup:
+		values, _ := asMap(c)
+		k, ok := key.(string)
+		if !ok {
+			return nil, e.errorf(n.Key, "map keys must be strings, got %s", typeOfValue(key))
+		}
+		value, ok := values[k]
+		if !ok {
+			return nil, e.errorf(n.Key, "key %q not found in map", k)
+		}
+		return value, nil
+	}
+
+	return nil, e.errorf(n, "can't index a value of type %s", typeOfValue(collection))
+}
+
+// evaluateSlice gets a part of an array or a string
+func (e *evaluator) evaluateSlice(n *sliceNode) (interface{}, error) {
+	collection, err := e.evaluate(n.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var length int
+	switch c := collection.(type) {
+	case []interface{}:
+		length = len(c)
+	case string:
+		length = utf8.RuneCountInString(c)
+	default:
+		return nil, e.errorf(n, "can't slice a value of type %s", typeOfValue(collection))
+	}
+
+	// Omitted bounds are the start and the end of the collection
+	low := 0
+	high := length
+	if n.Low != nil {
+		value, err := e.evaluate(n.Low)
+		if err != nil {
+			return nil, err
+		}
+		low, err = e.position(n.Low, value, length)
+		if err != nil {
+			return nil, err
+		}
+		if low < 0 || low > length {
+			return nil, e.errorf(n.Low, "slice bound %v out of range for length %d", value, length)
+		}
+	}
+	if n.High != nil {
+		value, err := e.evaluate(n.High)
+		if err != nil {
+			return nil, err
+		}
+		high, err = e.position(n.High, value, length)
+		if err != nil {
+			return nil, err
+		}
+		if high < 0 || high > length {
+			return nil, e.errorf(n.High, "slice bound %v out of range for length %d", value, length)
+		}
+	}
+	if low > high {
+		return nil, e.errorf(n, "invalid slice bounds %d > %d", low, high)
+	}
+
+	if c, ok := collection.([]interface{}); ok {
+		return append([]interface{}{}, c[low:high]...), nil
+	}
+	return string([]rune(collection.(string))[low:high]), nil
+}
+
+// evaluateSplat applies a traversal to every element of a collection
+// Repeated blocks with labels are visited in the order of their labels, null values become empty arrays
+// and any other value is visited as an array with a single element
+func (e *evaluator) evaluateSplat(n *splatNode) (interface{}, error) {
+	collection, err := e.evaluate(n.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var elements []interface{}
+	switch c := collection.(type) {
+	case nil:
+		return []interface{}{}, nil
+	case []interface{}:
+		elements = c
+	case blockGroup:
+		for _, key := range sortedKeys(c) {
+			elements = append(elements, c[key])
+		}
+	default:
+		elements = []interface{}{c}
+	}
+
+	result := []interface{}{}
+	for _, element := range elements {
+		e.splatElements = append(e.splatElements, element)
+		value, err := e.evaluate(n.Each)
+		e.splatElements = e.splatElements[:len(e.splatElements)-1]
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+
+	return result, nil
+}
+
+// position transforms an index into a position in a collection, counting from the end if negative
+func (e *evaluator) position(n node, value interface{}, length int) (int, error) {
+	i, ok := value.(int)
+	if !ok {
+		return 0, e.errorf(n, "index must be an integer, got %s", typeOfValue(value))
+	}
+	if i < 0 {
+		i += length
+	}
+	return i, nil
+}
+
+// attributeToValue gets the value of an attribute, arrays are stored separately from other values
+func attributeToValue(attribute Attribute) interface{} {
+	if attribute.Type == "array" {
+		if attribute.Array == nil {
+			return []interface{}{}
+		}
+		return attribute.Array
+	}
+	return attribute.Value
+}
+
+// interpolatedText gets the text of a value inside a string, only strings, numbers and booleans can be interpolated
+func interpolatedText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// valueToAttribute creates an attribute out of a value, arrays are stored separately from other values
+func valueToAttribute(name string, value interface{}) Attribute {
+	attribute := Attribute{
+		Name:  name,
+		Type:  typeOfValue(value),
+		Value: value,
+		Array: []interface{}{},
+	}
+	if array, ok := value.([]interface{}); ok {
+		attribute.Value = nil
+		attribute.Array = array
+	}
+	return attribute
+}
+
+// addBlockValue adds the values of a block to a map of values, so it can be used by references
+// Labeled blocks are nested under their name and each of their labels, e.g. backend.api
+func addBlockValue(values map[string]interface{}, name string, labels []string, blockValues map[string]interface{}) {
+	// Walk down the labels, creating a group of blocks for each one
+	keys := append([]string{name}, labels...)
+	current := values
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key].(blockGroup)
+		if !ok {
+			next = make(blockGroup)
+			current[key] = next
+		}
+		current = next
+	}
+	current[keys[len(keys)-1]] = blockValues
+}
+
+// blockGroup has the blocks that share the same name, indexed by their labels
+// It is used as a map, except that splats visit each block of the group
+type blockGroup map[string]interface{}
+
+// asMap gets the values of a map or of a group of blocks
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case blockGroup:
+		return v, true
+	}
+	return nil, false
+}
+
+// normalizeValue transforms groups of blocks into maps, so values only have the types of the NECL spec
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, element := range v {
+			normalized[i] = normalizeValue(element)
+		}
+		return normalized
+	case map[string]interface{}, blockGroup:
+		values, _ := asMap(v)
+		normalized := make(map[string]interface{}, len(values))
+		for key, element := range values {
+			normalized[key] = normalizeValue(element)
+		}
+		return normalized
+	}
+	return value
+}
+
+// typeOfValue gets the NECL type of a value
+func typeOfValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case int, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}, blockGroup:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// sortedKeys gets the keys of a map in order
+// Keys are sorted as numbers if all of them are integers, e.g. the labels of generated blocks
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	numeric := true
+	for key := range values {
+		keys = append(keys, key)
+		if _, err := strconv.Atoi(key); err != nil {
+			numeric = false
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if numeric {
+			a, _ := strconv.Atoi(keys[i])
+			b, _ := strconv.Atoi(keys[j])
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
@@ -7,6 +7,7 @@ type File struct {
 
 type Block struct {
 	Name       string
+	Labels     []string
 	Attributes map[string]Attribute
 	Blocks     map[string]Block
 }
@@ -0,0 +1,226 @@
+package necl
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileAccess has the settings of the functions that read files
+type fileAccess struct {
+	// Directory of relative paths, the working directory if empty
+	dir string
+	// Directory that files must be inside of, no file can be read if empty
+	root string
+	// Functions callable from templates
+	functions *FunctionRegistry
+}
+
+// registerFileFunctions adds the functions that read files
+func registerFileFunctions(r *FunctionRegistry, access fileAccess) {
+	r.mustRegister(Function{
+		Name:       "file",
+		Parameters: []Parameter{{Name: "path", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return access.readText(args[0].(string))
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "fileexists",
+		Parameters: []Parameter{{Name: "path", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			filename, err := access.resolve(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			info, err := os.Stat(filename)
+			if errors.Is(err, fs.ErrNotExist) {
+				return false, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return info.Mode().IsRegular(), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "fileset",
+		Parameters: []Parameter{{Name: "path", Type: TypeString}, {Name: "pattern", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return access.fileset(args[0].(string), args[1].(string))
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "filebase64",
+		Parameters: []Parameter{{Name: "path", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			content, err := access.read(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			return base64.StdEncoding.EncodeToString(content), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "templatefile",
+		Parameters: []Parameter{{Name: "path", Type: TypeString}, {Name: "vars", Type: TypeMap}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return access.template(args[0].(string), args[1].(map[string]interface{}))
+		},
+	})
+
+	for _, name := range []string{"file", "fileexists", "fileset", "filebase64", "templatefile"} {
+		r.parseFunctions[name] = true
+	}
+}
+
+// resolve gets the path of a file, checking that it's inside the allowed root
+func (a fileAccess) resolve(filename string) (string, error) {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(a.dir, filename)
+	}
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	// Only ParseNECLFile gives a root, expressions evaluated without a file can't read any file
+	if a.root == "" {
+		err := fmt.Errorf("path %s can't be read, files can only be read while parsing a file", filename)
+		return "", err
+	}
+
+	// Links are followed so they can't point outside of the root
+	root, err := filepath.Abs(a.root)
+	if err != nil {
+		return "", err
+	}
+	if evaluated, err := filepath.EvalSymlinks(root); err == nil {
+		root = evaluated
+	}
+	target := filename
+	if evaluated, err := filepath.EvalSymlinks(filename); err == nil {
+		target = evaluated
+	}
+	relative, err := filepath.Rel(root, target)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		err := fmt.Errorf("path %s is outside of the allowed root %s", filename, a.root)
+		return "", err
+	}
+	return filename, nil
+}
+
+// read gets the content of a file
+func (a fileAccess) read(filename string) ([]byte, error) {
+	resolved, err := a.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(resolved)
+	if err != nil {
+		err := fmt.Errorf("can't read %s: %s", filename, pathErrorReason(err))
+		return nil, err
+	}
+	return content, nil
+}
+
+// readText gets the content of a text file, which must be valid UTF-8
+func (a fileAccess) readText(filename string) (string, error) {
+	content, err := a.read(filename)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(content) {
+		err := fmt.Errorf("%s is not valid UTF-8 text, use filebase64 to read binary files", filename)
+		return "", err
+	}
+	return string(content), nil
+}
+
+// fileset gets the files of a directory and its subdirectories whose path matches a pattern
+// Paths are relative to the directory, use "/" as separator and are sorted
+func (a fileAccess) fileset(dir string, pattern string) (interface{}, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		err := fmt.Errorf("invalid pattern %q", pattern)
+		return nil, &ArgumentError{Index: 1, Err: err}
+	}
+	resolved, err := a.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	err = filepath.WalkDir(resolved, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(resolved, filename)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if matched, _ := path.Match(pattern, relative); matched {
+			matches = append(matches, relative)
+		}
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("can't list %s: %s", dir, pathErrorReason(err))
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	files := []interface{}{}
+	for _, match := range matches {
+		files = append(files, match)
+	}
+	return files, nil
+}
+
+// template renders a file with interpolations like "${name}", the variables are the only attributes it can use
+func (a fileAccess) template(filename string, vars map[string]interface{}) (interface{}, error) {
+	content, err := a.readText(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := parseTemplate(content)
+	if err != nil {
+		err := fmt.Errorf("template %s: %s", filename, err)
+		return nil, err
+	}
+	attributes := map[string]Attribute{}
+	for name, value := range vars {
+		attributes[name] = valueToAttribute(name, value)
+	}
+
+	e := &evaluator{
+		expression: content,
+		names:      attributeNames(attributes),
+		registry:   a.functions,
+	}
+	value, err := e.evaluate(n)
+	if err != nil {
+		err := fmt.Errorf("template %s: %s", filename, err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// pathErrorReason gets why an operation on a file failed, without the path that is already in the message
+func pathErrorReason(err error) error {
+	var pathError *fs.PathError
+	if errors.As(err, &pathError) {
+		return pathError.Err
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package necl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Verbs that can be used in a format
+const formatVerbs = "sqvtdobxXfFeEgG"
+
+// registerFormatFunctions adds the functions that build strings with printf-style formats
+func registerFormatFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "format",
+		Parameters: []Parameter{{Name: "format", Type: TypeString}},
+		Variadic:   &Parameter{Name: "values", Type: TypeAny},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return formatString(args[0].(string), args[1:])
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "formatlist",
+		Parameters: []Parameter{{Name: "format", Type: TypeString}},
+		Variadic:   &Parameter{Name: "values", Type: TypeAny},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return formatList(args[0].(string), args[1:])
+		},
+	})
+}
+
+// formatString replaces the verbs of a format, like %s or %03d, with values
+// Errors are ArgumentErrors pointing at the format or at the value that can't be formatted
+func formatString(format string, values []interface{}) (string, error) {
+	var result strings.Builder
+	next := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			result.WriteByte(format[i])
+			continue
+		}
+
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+			}
+		}
+		if i >= len(format) {
+			err := fmt.Errorf("incomplete verb %s at the end of the format", format[start:])
+			return "", &ArgumentError{Index: 0, Err: err}
+		}
+
+		verb := format[start : i+1]
+		if format[i] == '%' {
+			if verb != "%%" {
+				err := fmt.Errorf("invalid verb %s", verb)
+				return "", &ArgumentError{Index: 0, Err: err}
+			}
+			result.WriteByte('%')
+			continue
+		}
+		if strings.IndexByte(formatVerbs, format[i]) < 0 {
+			err := fmt.Errorf("unknown verb %s", verb)
+			return "", &ArgumentError{Index: 0, Err: err}
+		}
+		if next >= len(values) {
+			err := fmt.Errorf("verb %s has no value, only %d given", verb, len(values))
+			return "", &ArgumentError{Index: 0, Err: err}
+		}
+
+		value, ok := formatValue(format[i], values[next])
+		if !ok {
+			err := fmt.Errorf("verb %s can't format a %s", verb, typeOfValue(values[next]))
+			return "", &ArgumentError{Index: next + 1, Err: err}
+		}
+		result.WriteString(fmt.Sprintf(verb, value))
+		next++
+	}
+
+	if next < len(values) {
+		err := fmt.Errorf("too many values, the format uses %d of %d", next, len(values))
+		return "", &ArgumentError{Index: next + 1, Err: err}
+	}
+	return result.String(), nil
+}
+
+// formatValue converts a value to the Go value printed by a verb, if the verb can print it
+func formatValue(verb byte, value interface{}) (interface{}, bool) {
+	switch verb {
+	case 's':
+		return interpolatedText(value)
+	case 'v':
+		if value == nil {
+			return "null", true
+		}
+		return interpolatedText(value)
+	case 'q':
+		str, ok := value.(string)
+		return str, ok
+	case 't':
+		b, ok := value.(bool)
+		return b, ok
+	case 'd', 'o', 'b':
+		integer, err := integerArgument(value, "value")
+		return integer, err == nil
+	case 'x', 'X':
+		if str, ok := value.(string); ok {
+			return str, true
+		}
+		integer, err := integerArgument(value, "value")
+		return integer, err == nil
+	default:
+		switch v := value.(type) {
+		case int:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// formatList formats the elements of arrays one by one, other values are used for every element
+// All arrays must have the same length, which is the length of the result
+func formatList(format string, values []interface{}) (interface{}, error) {
+	length := -1
+	for i, value := range values {
+		array, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		if length >= 0 && len(array) != length {
+			err := fmt.Errorf("all arrays must have the same length, expected %d elements, got %d", length, len(array))
+			return nil, &ArgumentError{Index: i + 1, Err: err}
+		}
+		length = len(array)
+	}
+	if length < 0 {
+		err := fmt.Errorf("at least one value must be an array")
+		return nil, err
+	}
+
+	results := []interface{}{}
+	for element := 0; element < length; element++ {
+		elementValues := make([]interface{}, len(values))
+		for i, value := range values {
+			elementValues[i] = value
+			if array, ok := value.([]interface{}); ok {
+				elementValues[i] = array[element]
+			}
+		}
+
+		result, err := formatString(format, elementValues)
+		if err != nil {
+			var argumentError *ArgumentError
+			if errors.As(err, &argumentError) {
+				err = &ArgumentError{Index: argumentError.Index, Err: fmt.Errorf("element %d: %s", element, argumentError.Err)}
+			}
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
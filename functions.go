@@ -3,354 +3,369 @@ package necl
 import (
 	"fmt"
 	"math"
-	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-// Gets elements required for a string function
-func getValuesForStringFunc(targetsRaw string, attributes map[string]Attribute) ([]string, error) {
-	var targets []string
-	previousComma := 0
-	for commaIndex, findComma := range targetsRaw {
-		if string(findComma) == "," {
-			newElement := strings.TrimSpace(targetsRaw[previousComma:commaIndex])
-			targets = append(targets, newElement)
-			previousComma = int(commaIndex) + 1
-		}
-
-		// Last element
-		if commaIndex == len(targetsRaw)-1 && targets != nil {
-			newElement := strings.TrimSpace(targetsRaw[previousComma+1:])
-			targets = append(targets, newElement)
-		}
-	}
-
-	// Confirm there are 2 values
-	if targets[1] == "" {
-		err := fmt.Errorf("this function requires two values on: %s", targetsRaw)
-		return nil, err
-	}
-
-	// Search for attributes and transform into string
-	var targetsString []string
-	for _, val := range targets {
-		var stringVal string
-		stringVal = string(val)
-
-		// Search for attribute with name
-		if attributes[val].Value != nil {
-			stringVal = attributes[val].Value.(string)
-		} else {
-			stringVal = stringVal[1 : len(stringVal)-1]
-		}
+// registerBuiltinFunctions adds the functions that come by default with NECL to a registry
+func registerBuiltinFunctions(r *FunctionRegistry) {
+	registerStringFunctions(r)
+	registerMathFunctions(r)
+	registerLogicFunctions(r)
+	registerRegexFunctions(r)
+	registerFormatFunctions(r)
+	registerCollectionFunctions(r)
+	registerConversionFunctions(r)
+	registerEncodingFunctions(r)
+	registerHashFunctions(r)
+	registerFileFunctions(r, fileAccess{functions: r})
+	registerEnvFunctions(r, envAccess{})
+}
 
-		// Remove quote if not attribute
-		targetsString = append(targetsString, stringVal)
+// registerStringFunctions adds the functions that work on strings
+func registerStringFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "upper",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.ToUpper(args[0].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "lower",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.ToLower(args[0].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:     "concat",
+		Variadic: &Parameter{Name: "values", Type: TypeString},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			var values []string
+			for _, arg := range args {
+				values = append(values, arg.(string))
+			}
+			return strings.Join(values, " "), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "split",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "separator", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			elements := []interface{}{}
+			for _, element := range strings.Split(args[0].(string), args[1].(string)) {
+				elements = append(elements, element)
+			}
+			return elements, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "join",
+		Parameters: []Parameter{{Name: "list", Type: TypeArray}, {Name: "separator", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			var elements []string
+			for i, element := range args[0].([]interface{}) {
+				text, ok := interpolatedText(element)
+				if !ok {
+					err := fmt.Errorf("element %d is a %s, only strings, numbers and booleans can be joined", i, typeOfValue(element))
+					return nil, err
+				}
+				elements = append(elements, text)
+			}
+			return strings.Join(elements, args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "replace",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "old", Type: TypeString}, {Name: "new", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.ReplaceAll(args[0].(string), args[1].(string), args[2].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "trim",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "cutset", Type: TypeString, Optional: true}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			if len(args) == 1 {
+				return strings.TrimSpace(args[0].(string)), nil
+			}
+			return strings.Trim(args[0].(string), args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "trimprefix",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "prefix", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.TrimPrefix(args[0].(string), args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "trimsuffix",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "suffix", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.TrimSuffix(args[0].(string), args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "startswith",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "prefix", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.HasPrefix(args[0].(string), args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "endswith",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "suffix", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return strings.HasSuffix(args[0].(string), args[1].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "substr",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "offset", Type: TypeNumber}, {Name: "length", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return substring(args[0].(string), args[1], args[2])
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "repeat",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "count", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			count, err := integerArgument(args[1], "count")
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 {
+				err := fmt.Errorf("count can't be negative, got %d", count)
+				return nil, err
+			}
+			return strings.Repeat(args[0].(string), count), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "title",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return title(args[0].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "indent",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "spaces", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			spaces, err := integerArgument(args[1], "spaces")
+			if err != nil {
+				return nil, err
+			}
+			if spaces < 0 {
+				err := fmt.Errorf("spaces can't be negative, got %d", spaces)
+				return nil, err
+			}
+			// The first line is not indented, so the result can be placed after other text
+			return strings.ReplaceAll(args[0].(string), "\n", "\n"+strings.Repeat(" ", spaces)), nil
+		},
+	})
+	for _, name := range []string{"padleft", "padright"} {
+		left := name == "padleft"
+		r.mustRegister(Function{
+			Name:       name,
+			Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "width", Type: TypeNumber}, {Name: "padding", Type: TypeString, Optional: true}},
+			Implementation: func(args []interface{}) (interface{}, error) {
+				return pad(args, left)
+			},
+		})
 	}
-
-	return targetsString, nil
 }
 
-// StringFunctions is a super set of all string functions
-func StringFunctions(line string, attributes map[string]Attribute) (string, interface{}, error) {
-	// Upper
-	if strings.Contains(line, "upper(") {
-		// Get func value
-		target := strings.TrimSpace(line[6 : len(line)-1])
-
-		// Search for attribute with name
-		if attributes[target].Value != nil {
-			target = attributes[target].Value.(string)
-		} else {
-			target = target[1 : len(target)-1]
+// integerArgument gets an argument that must be an integer, e.g. 2 or 2.0 but not 2.5
+func integerArgument(arg interface{}, name string) (int, error) {
+	switch v := arg.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v), nil
 		}
-
-		// Perform operation
-		return "upper", strings.ToUpper(target), nil
 	}
+	err := fmt.Errorf("%s must be an integer, got %v", name, arg)
+	return 0, err
+}
 
-	// Lower
-	if strings.Contains(line, "lower(") {
-		// Get func value
-		target := strings.TrimSpace(line[6 : len(line)-1])
-
-		// Search for attribute with name
-		if attributes[target].Value != nil {
-			target = attributes[target].Value.(string)
-		} else {
-			target = target[1 : len(target)-1]
-		}
-
-		// Perform operation
-		return "lower", strings.ToLower(target), nil
+// substring gets length characters of a string starting at offset
+// A negative offset counts from the end of the string and a length of -1 takes all characters until the end
+func substring(str string, offsetArg interface{}, lengthArg interface{}) (interface{}, error) {
+	offset, err := integerArgument(offsetArg, "offset")
+	if err != nil {
+		return nil, err
 	}
-
-	// Concat
-	if strings.Contains(line, "concat(") {
-		// Get func values
-		targetsRaw := strings.TrimSpace(line[7 : len(line)-1])
-
-		// Get values
-		targets, err := getValuesForStringFunc(targetsRaw, attributes)
-		if err != nil {
-			return "concat", "", err
-		}
-
-		// Perform the operation
-		return "concat", strings.Join(targets, " "), nil
+	length, err := integerArgument(lengthArg, "length")
+	if err != nil {
+		return nil, err
 	}
 
-	// Contains
-	if strings.Contains(line, "contains(") {
-		// Get func values
-		targetsRaw := strings.TrimSpace(line[9 : len(line)-1])
-
-		// Get values
-		targets, err := getValuesForStringFunc(targetsRaw, attributes)
-		if err != nil {
-			return "contains", "", err
-		}
-		// Perform the operation
-		return "contains", strings.Contains(targets[0], targets[1]), nil
+	characters := []rune(str)
+	if offset < 0 {
+		offset += len(characters)
 	}
-
-	// Length
-	if strings.Contains(line, "length(") {
-		// Get func value
-		target := strings.TrimSpace(line[7 : len(line)-1])
-
-		// Search for attribute with name
-		if attributes[target].Value != nil {
-			target = attributes[target].Value.(string)
-		} else {
-			target = target[1 : len(target)-1]
-		}
-
-		// Perform operation
-		return "length", len(target), nil
+	if offset < 0 || offset > len(characters) {
+		err := fmt.Errorf("offset %v is out of range for a string of length %d", offsetArg, len(characters))
+		return nil, err
 	}
-
-	err := fmt.Errorf("unknown function on %s", line)
-	return "", "", err
-}
-
-// Gets elements required for a mathematical function
-func getValuesForMathFunc(targetsRaw string, attributes map[string]Attribute) ([]int, error) {
-	var targets []string
-	previousComma := 0
-	for commaIndex, findComma := range targetsRaw {
-		if string(findComma) == "," {
-			newElement := strings.TrimSpace(targetsRaw[previousComma:commaIndex])
-			targets = append(targets, newElement)
-			previousComma = int(commaIndex) + 1
-		}
-
-		// Last element
-		if commaIndex == len(targetsRaw)-1 && targets != nil {
-			newElement := strings.TrimSpace(targetsRaw[previousComma+1:])
-			targets = append(targets, newElement)
-		}
+	if length == -1 || offset+length > len(characters) {
+		length = len(characters) - offset
 	}
-
-	// Confirm there are 2 values
-	if targets[1] == "" {
-		err := fmt.Errorf("this function requires two values on: %s", targetsRaw)
+	if length < 0 {
+		err := fmt.Errorf("length can't be negative, got %d", length)
 		return nil, err
 	}
 
-	// Search for attributes and transform into int
-	var targetsInt []int
-	for _, val := range targets {
-		var intVal int
-		intVal, err := strconv.Atoi(val)
-		if err != nil {
-			// Search for attribute with name
-			if attributes[val].Value == nil {
-				err := fmt.Errorf("no attribute named %s was found", val)
-				return nil, err
-			}
-			intVal = attributes[val].Value.(int)
-		}
-
-		targetsInt = append(targetsInt, intVal)
-	}
-
-	return targetsInt, nil
+	return string(characters[offset : offset+length]), nil
 }
 
-// MathFunctions is a super set of all mathematical functions
-func MathFunctions(line string, attributes map[string]Attribute) (interface{}, error) {
-	// Power
-	if strings.Contains(line, "power(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[6 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForMathFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-
-		return int(math.Pow(float64(targets[0]), float64(targets[1]))), nil
-	}
-
-	// Floor division
-	if strings.Contains(line, "floor(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[6 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForMathFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
+// title uppercases the first letter of every word of a string
+func title(str string) string {
+	characters := []rune(str)
+	previous := ' '
+	for i, c := range characters {
+		if unicode.IsSpace(previous) {
+			characters[i] = unicode.ToUpper(c)
 		}
-
-		return int(math.Floor(float64(targets[0]) / float64(targets[1]))), nil
+		previous = c
 	}
-
-	// Remainder
-	if strings.Contains(line, "remainder(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[10 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForMathFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-
-		return targets[0] % targets[1], nil
-	}
-
-	err := fmt.Errorf("unknown function on %s", line)
-	return "", err
+	return string(characters)
 }
 
-// Gets elements required for a logical function
-func getValuesForLogicFunc(targetsRaw string, attributes map[string]Attribute) ([]bool, error) {
-	var targets []string
-	previousComma := 0
-	for commaIndex, findComma := range targetsRaw {
-		if string(findComma) == "," {
-			newElement := strings.TrimSpace(targetsRaw[previousComma:commaIndex])
-			targets = append(targets, newElement)
-			previousComma = int(commaIndex) + 1
-		}
-
-		// Last element
-		if commaIndex == len(targetsRaw)-1 && targets != nil {
-			newElement := strings.TrimSpace(targetsRaw[previousComma+1:])
-			targets = append(targets, newElement)
-		}
+// pad adds padding to the left or to the right of a string until it has a certain width
+// The padding is a space unless another one is given
+func pad(args []interface{}, left bool) (interface{}, error) {
+	str := args[0].(string)
+	width, err := integerArgument(args[1], "width")
+	if err != nil {
+		return nil, err
 	}
-
-	// Confirm there are 2 values
-	if targets[1] == "" {
-		err := fmt.Errorf("this function requires two values on: %s", targetsRaw)
+	padding := " "
+	if len(args) == 3 {
+		padding = args[2].(string)
+	}
+	if padding == "" {
+		err := fmt.Errorf("padding can't be empty")
 		return nil, err
 	}
 
-	// Search for attributes and transform into boolean
-	var targetsBool []bool
-	for _, val := range targets {
-		var boolVal bool
-		boolVal, err := strconv.ParseBool(val)
-		if err != nil {
-			// Search for attribute with name
-			if attributes[val].Value == nil {
-				err := fmt.Errorf("no attribute named %s was found", val)
-				return nil, err
-			}
-			boolVal = attributes[val].Value.(bool)
-		}
-
-		targetsBool = append(targetsBool, boolVal)
+	missing := width - utf8.RuneCountInString(str)
+	if missing <= 0 {
+		return str, nil
 	}
-
-	return targetsBool, nil
+	fill := []rune(strings.Repeat(padding, missing))[:missing]
+	if left {
+		return string(fill) + str, nil
+	}
+	return str + string(fill), nil
 }
 
-// LogicFunctions is a super set of all mathematical functions
-func LogicFunctions(line string, attributes map[string]Attribute) (interface{}, error) {
-
-	// XOR
-	if strings.Contains(line, "xor(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[4 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
+// registerLogicFunctions adds the functions that work on booleans and other values
+func registerLogicFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "coalesce",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Variadic:   &Parameter{Name: "values", Type: TypeAny},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if arg != nil && arg != "" {
+					return arg, nil
+				}
+			}
+			err := fmt.Errorf("all arguments are null or empty strings")
 			return nil, err
-		}
-		return targets[0] != targets[1], nil
+		},
+	})
+
+	// Gate logic, and and or accept any number of conditions, the other gates compare two conditions
+	r.mustRegister(Function{
+		Name:       "and",
+		Parameters: []Parameter{{Name: "cond1", Type: TypeBoolean}},
+		Variadic:   &Parameter{Name: "conds", Type: TypeBoolean},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if !arg.(bool) {
+					return false, nil
+				}
+			}
+			return true, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "or",
+		Parameters: []Parameter{{Name: "cond1", Type: TypeBoolean}},
+		Variadic:   &Parameter{Name: "conds", Type: TypeBoolean},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if arg.(bool) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	})
+	gates := map[string]func(a, b bool) bool{
+		"nand": func(a, b bool) bool { return !(a && b) },
+		"nor":  func(a, b bool) bool { return !(a || b) },
+		"xor":  func(a, b bool) bool { return a != b },
+		"xnor": func(a, b bool) bool { return a == b },
 	}
-
-	// XNOR
-	if strings.Contains(line, "xnor(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[5 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-		return !(targets[0] != targets[1]), nil
+	for name, gate := range gates {
+		gate := gate
+		r.mustRegister(Function{
+			Name:       name,
+			Parameters: []Parameter{{Name: "cond1", Type: TypeBoolean}, {Name: "cond2", Type: TypeBoolean}},
+			Implementation: func(args []interface{}) (interface{}, error) {
+				return gate(args[0].(bool), args[1].(bool)), nil
+			},
+		})
 	}
+}
 
-	// NAND
-	if strings.Contains(line, "nand(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[5 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-		return !(targets[0] == targets[1]), nil
+// callFunctionExpression calls the function of an expression with a single call, e.g. upper("text")
+func callFunctionExpression(line string, attributes map[string]Attribute) (string, interface{}, error) {
+	n, err := parseExpression(line)
+	if err != nil {
+		return "", nil, err
 	}
-
-	// NOR
-	if strings.Contains(line, "nor(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[4 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-		return !(targets[0] || targets[1]), nil
+	call, ok := n.(*callNode)
+	if !ok {
+		err := fmt.Errorf("unknown function on %s", line)
+		return "", nil, err
 	}
 
-	// AND
-	if strings.Contains(line, "and(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[4 : len(line)-1])
-
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-		return targets[0] == targets[1], nil
+	value, err := evaluateExpression(line, attributeNames(attributes), nil)
+	if err != nil {
+		return call.Name, nil, err
 	}
+	return call.Name, value, nil
+}
 
-	// OR
-	if strings.Contains(line, "or(") {
-		// Get func value
-		targetsRaw := strings.TrimSpace(line[3 : len(line)-1])
+// StringFunctions is a super set of all string functions
+// It returns the name of the function that was called and its result
+//
+// Deprecated: function calls are evaluated by ParseNECLFile, this is kept for existing callers
+func StringFunctions(line string, attributes map[string]Attribute) (string, interface{}, error) {
+	return callFunctionExpression(line, attributes)
+}
 
-		// Get targets
-		targets, err := getValuesForLogicFunc(targetsRaw, attributes)
-		if err != nil {
-			return nil, err
-		}
-		return targets[0] || targets[1], nil
-	}
+// MathFunctions is a super set of all mathematical functions
+//
+// Deprecated: function calls are evaluated by ParseNECLFile, this is kept for existing callers
+func MathFunctions(line string, attributes map[string]Attribute) (interface{}, error) {
+	_, value, err := callFunctionExpression(line, attributes)
+	return value, err
+}
 
-	err := fmt.Errorf("unknown function on %s", line)
-	return false, err
+// LogicFunctions is a super set of all logical functions
+//
+// Deprecated: function calls are evaluated by ParseNECLFile, this is kept for existing callers
+func LogicFunctions(line string, attributes map[string]Attribute) (interface{}, error) {
+	_, value, err := callFunctionExpression(line, attributes)
+	return value, err
 }
@@ -0,0 +1,371 @@
+package necl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dependencyGraph links every attribute of a document to the attributes it references
+type dependencyGraph struct {
+	root         *body
+	attributes   []*attributeDefinition
+	dependencies map[*attributeDefinition][]*attributeDefinition
+}
+
+// newDependencyGraph finds the dependencies of every attribute of a document
+func newDependencyGraph(root *body) *dependencyGraph {
+	g := &dependencyGraph{
+		root:         root,
+		dependencies: make(map[*attributeDefinition][]*attributeDefinition),
+	}
+	g.addBody(root)
+
+	return g
+}
+
+// addBody adds the attributes of a body and of its nested blocks to the graph, in the order they are written
+func (g *dependencyGraph) addBody(b *body) {
+	for _, definition := range b.Attributes {
+		g.attributes = append(g.attributes, definition)
+		if definition.Multiline {
+			continue
+		}
+		for _, path := range expressionReferences(definition.Value) {
+			g.dependencies[definition] = append(g.dependencies[definition], g.resolve(b, path)...)
+		}
+	}
+
+	// Generated blocks are only evaluated once they are expanded
+	for _, nested := range b.Blocks {
+		if nested.Template == nil {
+			g.addBody(nested)
+		}
+	}
+}
+
+// addTemplate adds the header of a generated block to the graph, so its collection, condition and labels can be
+// evaluated after the attributes they reference
+func (g *dependencyGraph) addTemplate(template *body) *attributeDefinition {
+	definition := &attributeDefinition{
+		Name: template.Name,
+		Line: template.Line,
+		Body: template.Parent,
+	}
+
+	var paths [][]string
+	locals := make(map[string]bool)
+	if template.Template.Condition != nil {
+		nodeReferences(template.Template.Condition, locals, &paths)
+	} else {
+		nodeReferences(template.Template.Collection, locals, &paths)
+		locals[template.Template.ValueName] = true
+		if template.Template.KeyName != "" {
+			locals[template.Template.KeyName] = true
+		}
+	}
+	for _, label := range template.Template.Labels {
+		nodeReferences(label, locals, &paths)
+	}
+	for _, path := range paths {
+		g.dependencies[definition] = append(g.dependencies[definition], g.resolve(template.Parent, path)...)
+	}
+
+	return definition
+}
+
+// resolve finds the attributes a path references from a body
+// Names are looked up from the innermost body to the root, the first body that has the name is used
+func (g *dependencyGraph) resolve(b *body, path []string) []*attributeDefinition {
+	switch path[0] {
+	case "self":
+		return resolveInBody(b, path[1:])
+	case "root":
+		return resolveInBody(g.root, path[1:])
+	case "parent":
+		if b.Parent == nil {
+			return nil
+		}
+		return resolveInBody(b.Parent, path[1:])
+	}
+
+	for current := b; current != nil; current = current.Parent {
+		// Loop variables of generated blocks are already known
+		if _, ok := current.Variables[path[0]]; ok {
+			return nil
+		}
+
+		if current.hasName(path[0]) {
+			return resolveInBody(current, path)
+		}
+	}
+
+	// Unknown names are reported when the attribute is evaluated
+	return nil
+}
+
+// resolveInBody finds the attributes a path references inside a body
+// When the path doesn't reach an attribute, every attribute of the blocks it reaches is referenced
+func resolveInBody(b *body, path []string) []*attributeDefinition {
+	if len(path) == 0 {
+		return b.allAttributes()
+	}
+
+	// Attributes take precedence over blocks with the same name
+	for _, definition := range b.Attributes {
+		if definition.Name == path[0] {
+			return []*attributeDefinition{definition}
+		}
+	}
+
+	var blocks []*body
+	for _, nested := range b.Blocks {
+		if nested.Template == nil && nested.Name == path[0] {
+			blocks = append(blocks, nested)
+		}
+	}
+	if blocks == nil {
+		return b.allAttributes()
+	}
+
+	return resolveInBlocks(blocks, path[1:], 0)
+}
+
+// resolveInBlocks finds the attributes a path references inside blocks with the same name
+// The next parts of the path select the labels of the blocks, one label at a time
+func resolveInBlocks(blocks []*body, path []string, label int) []*attributeDefinition {
+	var definitions []*attributeDefinition
+
+	labeled := false
+	for _, block := range blocks {
+		if len(block.Labels) > label {
+			labeled = true
+		}
+	}
+
+	// All labels were matched, look inside the blocks
+	if !labeled {
+		for _, block := range blocks {
+			definitions = append(definitions, resolveInBody(block, path)...)
+		}
+		return definitions
+	}
+
+	// Select the blocks with the next label
+	var selected []*body
+	if len(path) > 0 {
+		for _, block := range blocks {
+			if len(block.Labels) > label && block.Labels[label] == path[0] {
+				selected = append(selected, block)
+			}
+		}
+	}
+	if selected == nil {
+		for _, block := range blocks {
+			definitions = append(definitions, block.allAttributes()...)
+		}
+		return definitions
+	}
+
+	return resolveInBlocks(selected, path[1:], label+1)
+}
+
+// hasName checks if a body defines an attribute or a block with a name
+func (b *body) hasName(name string) bool {
+	for _, definition := range b.Attributes {
+		if definition.Name == name {
+			return true
+		}
+	}
+	for _, nested := range b.Blocks {
+		if nested.Template == nil && nested.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allAttributes gets the attributes of a body and of all of its nested blocks
+func (b *body) allAttributes() []*attributeDefinition {
+	definitions := append([]*attributeDefinition{}, b.Attributes...)
+	for _, nested := range b.Blocks {
+		if nested.Template == nil {
+			definitions = append(definitions, nested.allAttributes()...)
+		}
+	}
+	return definitions
+}
+
+// order sorts the attributes so every attribute comes after the attributes it references
+// Attributes that don't depend on each other keep the order they are written in
+func (g *dependencyGraph) order() ([]*attributeDefinition, error) {
+	return g.orderOf(g.attributes)
+}
+
+// orderOf sorts the given attributes and the attributes they reference, directly or indirectly
+func (g *dependencyGraph) orderOf(definitions []*attributeDefinition) ([]*attributeDefinition, error) {
+	var ordered []*attributeDefinition
+	visited := make(map[*attributeDefinition]bool)
+	visiting := make(map[*attributeDefinition]bool)
+	var stack []*attributeDefinition
+
+	var visit func(definition *attributeDefinition) error
+	visit = func(definition *attributeDefinition) error {
+		if visited[definition] {
+			return nil
+		}
+
+		// The attribute is already being visited, so it references itself through the attributes in the stack
+		if visiting[definition] {
+			var cycle []string
+			for i, previous := range stack {
+				if previous == definition {
+					for _, inCycle := range stack[i:] {
+						cycle = append(cycle, inCycle.path())
+					}
+					break
+				}
+			}
+			cycle = append(cycle, definition.path())
+			err := fmt.Errorf("reference cycle on line %d: %s", definition.Line+1, strings.Join(cycle, " -> "))
+			return err
+		}
+
+		visiting[definition] = true
+		stack = append(stack, definition)
+		for _, dependency := range g.dependencies[definition] {
+			err := visit(dependency)
+			if err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		visiting[definition] = false
+		visited[definition] = true
+		ordered = append(ordered, definition)
+
+		return nil
+	}
+
+	for _, definition := range definitions {
+		err := visit(definition)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// path gets the full path of an attribute, e.g. metadata.labels.app
+func (definition *attributeDefinition) path() string {
+	parts := []string{definition.Name}
+	for b := definition.Body; b != nil && b.Parent != nil; b = b.Parent {
+		parts = append([]string{blockKey(b.Name, b.Labels)}, parts...)
+	}
+	return strings.Join(parts, ".")
+}
+
+// expressionReferences finds the paths referenced by an expression, e.g. [metadata labels app] for metadata.labels.app
+// A path stops at the first part that can't be known without evaluating the expression, like ports[i]
+func expressionReferences(expression string) [][]string {
+	n, err := parseExpression(expression)
+	if err != nil {
+		// Invalid expressions are reported when the attribute is evaluated
+		return nil
+	}
+
+	var paths [][]string
+	nodeReferences(n, map[string]bool{}, &paths)
+	return paths
+}
+
+// nodeReferences adds the paths referenced by a node to paths
+// Loop variables are not references, locals has the ones declared by the loops around the node
+func nodeReferences(n node, locals map[string]bool, paths *[][]string) {
+	if path, ok := referencePath(n); ok {
+		if !locals[path[0]] {
+			*paths = append(*paths, path)
+		}
+		return
+	}
+
+	switch n := n.(type) {
+	case *arrayNode:
+		for _, element := range n.Elements {
+			nodeReferences(element, locals, paths)
+		}
+	case *conditionalNode:
+		nodeReferences(n.Condition, locals, paths)
+		nodeReferences(n.Positive, locals, paths)
+		nodeReferences(n.Negative, locals, paths)
+	case *forNode:
+		nodeReferences(n.Collection, locals, paths)
+		inner := map[string]bool{n.ValueName: true}
+		if n.KeyName != "" {
+			inner[n.KeyName] = true
+		}
+		for name := range locals {
+			inner[name] = true
+		}
+		for _, outcome := range []node{n.Key, n.Value, n.Filter} {
+			if outcome != nil {
+				nodeReferences(outcome, inner, paths)
+			}
+		}
+	case *interpolationNode:
+		for _, part := range n.Parts {
+			nodeReferences(part, locals, paths)
+		}
+	case *callNode:
+		for _, argument := range n.Arguments {
+			nodeReferences(argument, locals, paths)
+		}
+	case *binaryNode:
+		nodeReferences(n.Left, locals, paths)
+		nodeReferences(n.Right, locals, paths)
+	case *unaryNode:
+		nodeReferences(n.Operand, locals, paths)
+	case *indexNode:
+		nodeReferences(n.Collection, locals, paths)
+		nodeReferences(n.Key, locals, paths)
+	case *sliceNode:
+		nodeReferences(n.Collection, locals, paths)
+		for _, bound := range []node{n.Low, n.High} {
+			if bound != nil {
+				nodeReferences(bound, locals, paths)
+			}
+		}
+	case *getAttributeNode:
+		nodeReferences(n.Collection, locals, paths)
+	case *splatNode:
+		nodeReferences(n.Collection, locals, paths)
+		nodeReferences(n.Each, locals, paths)
+	}
+}
+
+// referencePath gets the path of a node made only of names and string keys, e.g. metadata.labels["app"]
+func referencePath(n node) ([]string, bool) {
+	switch n := n.(type) {
+	case *referenceNode:
+		return []string{n.Name}, true
+	case *getAttributeNode:
+		path, ok := referencePath(n.Collection)
+		if ok {
+			return append(path, n.Name), true
+		}
+	case *indexNode:
+		key, isLiteral := n.Key.(*literalNode)
+		if !isLiteral {
+			break
+		}
+		name, isString := key.Value.(string)
+		if !isString {
+			break
+		}
+		path, ok := referencePath(n.Collection)
+		if ok {
+			return append(path, name), true
+		}
+	}
+	return nil, false
+}
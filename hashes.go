@@ -0,0 +1,96 @@
+package necl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// Namespaces of name-based UUIDs that can be given by name, from RFC 4122
+var uuidNamespaces = map[string]string{
+	"dns":  "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+	"url":  "6ba7b811-9dad-11d1-80b4-00c04fd430c8",
+	"oid":  "6ba7b812-9dad-11d1-80b4-00c04fd430c8",
+	"x500": "6ba7b814-9dad-11d1-80b4-00c04fd430c8",
+}
+
+// registerHashFunctions adds the functions that calculate hashes and checksums of strings
+// All results are lowercase hexadecimal strings
+func registerHashFunctions(r *FunctionRegistry) {
+	hashes := map[string]func() hash.Hash{
+		"md5":    md5.New,
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+		"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	}
+	for name, newHash := range hashes {
+		newHash := newHash
+		r.mustRegister(Function{
+			Name:       name,
+			Parameters: []Parameter{{Name: "str", Type: TypeString}},
+			Implementation: func(args []interface{}) (interface{}, error) {
+				h := newHash()
+				h.Write([]byte(args[0].(string)))
+				return hex.EncodeToString(h.Sum(nil)), nil
+			},
+		})
+	}
+	r.mustRegister(Function{
+		Name:       "hmac_sha256",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "key", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			h := hmac.New(sha256.New, []byte(args[1].(string)))
+			h.Write([]byte(args[0].(string)))
+			return hex.EncodeToString(h.Sum(nil)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "uuidv5",
+		Parameters: []Parameter{{Name: "namespace", Type: TypeString}, {Name: "name", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			namespace := args[0].(string)
+			if uuid, ok := uuidNamespaces[namespace]; ok {
+				namespace = uuid
+			}
+			namespaceBytes, err := parseUUID(namespace)
+			if err != nil {
+				return nil, &ArgumentError{Index: 0, Err: err}
+			}
+			return uuidv5(namespaceBytes, args[1].(string)), nil
+		},
+	})
+}
+
+// parseUUID gets the bytes of a UUID written like 6ba7b810-9dad-11d1-80b4-00c04fd430c8
+func parseUUID(uuid string) ([]byte, error) {
+	parts := strings.Split(uuid, "-")
+	if len(parts) == 5 && len(parts[0]) == 8 && len(parts[1]) == 4 && len(parts[2]) == 4 && len(parts[3]) == 4 && len(parts[4]) == 12 {
+		bytes, err := hex.DecodeString(strings.Join(parts, ""))
+		if err == nil {
+			return bytes, nil
+		}
+	}
+	err := fmt.Errorf("namespace must be dns, url, oid, x500 or a UUID, got %q", uuid)
+	return nil, err
+}
+
+// uuidv5 creates the name-based UUID of a name in a namespace, as described by RFC 4122
+func uuidv5(namespace []byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace)
+	h.Write([]byte(name))
+	uuid := h.Sum(nil)[:16]
+	uuid[6] = (uuid[6] & 0x0f) | 0x50
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	encoded := hex.EncodeToString(uuid)
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32]
+}
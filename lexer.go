@@ -0,0 +1,183 @@
+package necl
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenType is the kind of a token found in an expression
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+// token is a single lexical element of an expression
+type token struct {
+	Type tokenType
+	Text string
+	Pos  int
+}
+
+// Operators and delimiters, longest first so "==" is matched before "="
+var expressionOperators = []string{
+	"..=", "==", "!=", "<=", ">=", "&&", "||", "=>", "..",
+	"+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "=",
+	"(", ")", "[", "]", ",", ".",
+}
+
+// tokenize splits an expression into tokens
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+
+	i := 0
+	for i < len(expression) {
+		c := rune(expression[i])
+
+		// Whitespace
+		if unicode.IsSpace(c) {
+			i++
+			continue
+		}
+
+		// String, delimited by double or single quotes
+		if c == '"' || c == '\'' {
+			end, err := scanString(expression, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{Type: tokenString, Text: expression[i+1 : end], Pos: i})
+			i = end + 1
+			continue
+		}
+
+		// Number, a fraction is only read if a digit follows the dot so "1..5" is a range
+		// Numbers after a "." are labels, e.g. backend.node.0.port, so they never have a fraction
+		if unicode.IsDigit(c) {
+			start := i
+			for i < len(expression) && unicode.IsDigit(rune(expression[i])) {
+				i++
+			}
+			afterDot := len(tokens) > 0 && tokens[len(tokens)-1].Type == tokenOperator && tokens[len(tokens)-1].Text == "."
+			if !afterDot && i+1 < len(expression) && expression[i] == '.' && unicode.IsDigit(rune(expression[i+1])) {
+				i++
+				for i < len(expression) && unicode.IsDigit(rune(expression[i])) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{Type: tokenNumber, Text: expression[start:i], Pos: start})
+			continue
+		}
+
+		// Identifier
+		if isIdentifierStart(c) {
+			start := i
+			for i < len(expression) && isIdentifierPart(rune(expression[i])) {
+				i++
+			}
+			tokens = append(tokens, token{Type: tokenIdentifier, Text: expression[start:i], Pos: start})
+			continue
+		}
+
+		// Operators and delimiters
+		found := false
+		for _, operator := range expressionOperators {
+			if strings.HasPrefix(expression[i:], operator) {
+				tokens = append(tokens, token{Type: tokenOperator, Text: operator, Pos: i})
+				i += len(operator)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, positionError(expression, i, "unexpected character %q", c)
+		}
+	}
+
+	tokens = append(tokens, token{Type: tokenEOF, Pos: len(expression)})
+
+	return tokens, nil
+}
+
+// scanString finds the closing quote of a string that starts at start
+// Quotes inside interpolations don't close the string, e.g. "Hello, ${upper("world")}"
+func scanString(expression string, start int) (int, error) {
+	quote := expression[start]
+	i := start + 1
+	for i < len(expression) {
+		switch {
+		case expression[i] == quote:
+			return i, nil
+		case strings.HasPrefix(expression[i:], "$${"):
+			i += 3
+		case strings.HasPrefix(expression[i:], "${"):
+			end, err := scanInterpolation(expression, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	return 0, positionError(expression, start, "unterminated string")
+}
+
+// scanInterpolation finds the end of an interpolation that starts at start, just after its closing "}"
+func scanInterpolation(expression string, start int) (int, error) {
+	depth := 0
+	i := start + 1
+	for i < len(expression) {
+		switch expression[i] {
+		case '"', '\'':
+			end, err := scanString(expression, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+		i++
+	}
+	return 0, positionError(expression, start, "unterminated interpolation")
+}
+
+// isIdentifierStart checks if a character can start an attribute name
+func isIdentifierStart(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
+}
+
+// isIdentifierPart checks if a character can be part of an attribute name
+func isIdentifierPart(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
+// positionError creates an error that points at a column of an expression
+// Expressions with many lines, like templates, point at a line and only show that line
+func positionError(expression string, pos int, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if !strings.Contains(expression, "\n") {
+		return fmt.Errorf("%s at column %d of: %s", message, pos+1, expression)
+	}
+
+	start := strings.LastIndex(expression[:pos], "\n") + 1
+	end := strings.Index(expression[pos:], "\n")
+	if end < 0 {
+		end = len(expression)
+	} else {
+		end += pos
+	}
+	line := strings.Count(expression[:start], "\n") + 1
+	return fmt.Errorf("%s at line %d, column %d of: %s", message, line, pos-start+1, expression[start:end])
+}
@@ -0,0 +1,285 @@
+package necl
+
+import (
+	"fmt"
+	"math"
+)
+
+// registerMathFunctions adds the functions that work on numbers
+// Functions keep integers as integers when the result is a whole number that fits in an integer
+func registerMathFunctions(r *FunctionRegistry) {
+	pow := Function{
+		Name:       "pow",
+		Parameters: []Parameter{{Name: "base", Type: TypeNumber}, {Name: "exponent", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return power(args[0], args[1])
+		},
+	}
+	r.mustRegister(pow)
+	pow.Name = "power"
+	r.mustRegister(pow)
+
+	r.mustRegister(Function{
+		Name:       "remainder",
+		Parameters: []Parameter{{Name: "dividend", Type: TypeNumber}, {Name: "divisor", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return arithmetic("%", args[0], args[1])
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "abs",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			if v, ok := args[0].(int); ok {
+				if v == math.MinInt {
+					err := fmt.Errorf("overflow, the absolute value of %d is too large for an integer", v)
+					return nil, err
+				}
+				if v < 0 {
+					return -v, nil
+				}
+				return v, nil
+			}
+			return math.Abs(args[0].(float64)), nil
+		},
+	})
+	for name, function := range map[string]func(float64) float64{"ceil": math.Ceil, "floor": math.Floor, "round": math.Round} {
+		function := function
+		r.mustRegister(Function{
+			Name:       name,
+			Parameters: []Parameter{{Name: "number", Type: TypeNumber}},
+			Implementation: func(args []interface{}) (interface{}, error) {
+				if v, ok := args[0].(int); ok {
+					return v, nil
+				}
+				return floatToInteger(function(args[0].(float64)))
+			},
+		})
+	}
+	r.mustRegister(Function{
+		Name:       "sqrt",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			number, _ := toFloat(args[0])
+			if number < 0 {
+				err := fmt.Errorf("can't get the square root of a negative number, got %v", args[0])
+				return nil, err
+			}
+			result := math.Sqrt(number)
+			if integer, ok := args[0].(int); ok {
+				// Perfect squares have an integer root, the float root is only rounded to find it
+				root := uint64(math.Round(result))
+				if root*root == uint64(integer) {
+					return int(root), nil
+				}
+			}
+			return result, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "log",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}, {Name: "base", Type: TypeNumber, Optional: true}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			number, _ := toFloat(args[0])
+			if number <= 0 {
+				err := fmt.Errorf("the logarithm is only defined for positive numbers, got %v", args[0])
+				return nil, &ArgumentError{Index: 0, Err: err}
+			}
+			if len(args) == 1 {
+				// The natural logarithm of an integer is only a whole number for 1
+				if _, ok := args[0].(int); ok && number == 1 {
+					return 0, nil
+				}
+				return math.Log(number), nil
+			}
+			base, _ := toFloat(args[1])
+			if base <= 0 || base == 1 {
+				err := fmt.Errorf("the base must be a positive number other than 1, got %v", args[1])
+				return nil, &ArgumentError{Index: 1, Err: err}
+			}
+			return logarithm(args[0], args[1]), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "clamp",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}, {Name: "min", Type: TypeNumber}, {Name: "max", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			number, _ := toFloat(args[0])
+			low, _ := toFloat(args[1])
+			high, _ := toFloat(args[2])
+			if low > high {
+				err := fmt.Errorf("min %v is greater than max %v", args[1], args[2])
+				return nil, err
+			}
+			if number < low {
+				return args[1], nil
+			}
+			if number > high {
+				return args[2], nil
+			}
+			return args[0], nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "min",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}},
+		Variadic:   &Parameter{Name: "numbers", Type: TypeNumber},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return extremeNumber(args, func(a, b float64) bool { return a < b }), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "max",
+		Parameters: []Parameter{{Name: "number", Type: TypeNumber}},
+		Variadic:   &Parameter{Name: "numbers", Type: TypeNumber},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			return extremeNumber(args, func(a, b float64) bool { return a > b }), nil
+		},
+	})
+}
+
+// power raises a number to a power
+// The result is an integer when both numbers are integers and the exponent isn't negative
+func power(baseArg interface{}, exponentArg interface{}) (interface{}, error) {
+	base, _ := toFloat(baseArg)
+	exponent, _ := toFloat(exponentArg)
+	result := math.Pow(base, exponent)
+	if math.IsNaN(result) {
+		err := fmt.Errorf("%v to the power of %v is not a real number", baseArg, exponentArg)
+		return nil, err
+	}
+	if math.IsInf(result, 0) {
+		err := fmt.Errorf("overflow, %v to the power of %v is too large", baseArg, exponentArg)
+		return nil, err
+	}
+
+	integerBase, ok1 := baseArg.(int)
+	integerExponent, ok2 := exponentArg.(int)
+	if !ok1 || !ok2 || integerExponent < 0 {
+		return result, nil
+	}
+	// Multiply as integers, the float result may have lost precision
+	integer, ok := integerPower(integerBase, integerExponent)
+	if !ok {
+		err := fmt.Errorf("overflow, %v to the power of %v is too large for an integer", baseArg, exponentArg)
+		return nil, err
+	}
+	return integer, nil
+}
+
+// integerPower raises an integer to a non negative exponent by squaring, it's false if the result overflows
+func integerPower(base int, exponent int) (int, bool) {
+	result := 1
+	for exponent > 0 {
+		var ok bool
+		if exponent%2 == 1 {
+			result, ok = multiplyIntegers(result, base)
+			if !ok {
+				return 0, false
+			}
+		}
+		exponent /= 2
+		if exponent > 0 {
+			base, ok = multiplyIntegers(base, base)
+			if !ok {
+				return 0, false
+			}
+		}
+	}
+	return result, true
+}
+
+// multiplyIntegers multiplies two integers, it's false if the result overflows
+func multiplyIntegers(a int, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	if (a == -1 && b == math.MinInt) || (b == -1 && a == math.MinInt) {
+		return 0, false
+	}
+	product := a * b
+	if product/b != a {
+		return 0, false
+	}
+	return product, true
+}
+
+// logarithm gets the logarithm of a number in a base
+// The result is an integer when both numbers are integers and the number is an exact power of the base
+func logarithm(numberArg interface{}, baseArg interface{}) interface{} {
+	number, _ := toFloat(numberArg)
+	base, _ := toFloat(baseArg)
+	var result float64
+	switch base {
+	case 2:
+		result = math.Log2(number)
+	case 10:
+		result = math.Log10(number)
+	default:
+		result = math.Log(number) / math.Log(base)
+	}
+
+	integerNumber, ok1 := numberArg.(int)
+	integerBase, ok2 := baseArg.(int)
+	if !ok1 || !ok2 || integerBase < 2 {
+		return result
+	}
+	// The float result may be off by a rounding error, so the nearest integer is checked by raising the base to it
+	exponent := math.Round(result)
+	if exponent >= 0 {
+		if power, ok := integerPower(integerBase, int(exponent)); ok && power == integerNumber {
+			return int(exponent)
+		}
+	}
+	return result
+}
+
+// addIntegers adds two integers, it's false if the result overflows
+func addIntegers(a int, b int) (int, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+// subtractIntegers subtracts an integer from another, it's false if the result overflows
+func subtractIntegers(a int, b int) (int, bool) {
+	difference := a - b
+	if (b > 0 && difference > a) || (b < 0 && difference < a) {
+		return 0, false
+	}
+	return difference, true
+}
+
+// floatToInteger converts a whole number to an integer, if it fits in one
+func floatToInteger(number float64) (interface{}, error) {
+	if math.IsNaN(number) || math.IsInf(number, 0) || number >= math.MaxInt || number < math.MinInt {
+		err := fmt.Errorf("overflow, %v is too large for an integer", number)
+		return nil, err
+	}
+	return int(number), nil
+}
+
+// extremeNumber gets the number that comes first according to before, e.g. the smallest one
+// The result is an integer if all numbers are integers
+func extremeNumber(args []interface{}, before func(a, b float64) bool) interface{} {
+	result := args[0]
+	resultFloat, _ := toFloat(result)
+	allIntegers := true
+	for _, arg := range args {
+		if _, ok := arg.(int); !ok {
+			allIntegers = false
+		}
+		value, _ := toFloat(arg)
+		if before(value, resultFloat) {
+			result = arg
+			resultFloat = value
+		}
+	}
+
+	if allIntegers {
+		return result
+	}
+	return resultFloat
+}
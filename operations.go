@@ -3,164 +3,224 @@ package necl
 import (
 	"errors"
 	"fmt"
-	"strconv"
+	"math"
+	"reflect"
 	"strings"
 )
 
-// performComparison will make a comparison check against 2 values and return a boolean as an interface
+// PerformComparison will make a comparison check against 2 values and return a boolean as an interface
+//
+// Deprecated: attributes are evaluated by ParseNECLFile, this is kept for existing callers
 func PerformComparison(lineRaw string, currentAttributes map[string]Attribute) (bool, error) {
-	// Discover the comparison
-	comparisons := []string{"==", "!=", "<", "<=", ">", ">="}
-	comparison := ""
-	for _, c := range comparisons {
-		if strings.Contains(lineRaw, c) {
-			comparison = c
-		}
-	}
-	if comparison == "" {
-		err := fmt.Errorf("unknown comparator on line: %s", lineRaw)
+	value, err := evaluateExpression(lineRaw, attributeNames(currentAttributes), nil)
+	if err != nil {
 		return false, err
 	}
 
-	// Get values
-	value1Str := ""
-	value2Str := ""
-	double := false
-	i := strings.Index(lineRaw, comparison)
-
-	for _, c := range []string{"==", "!=", "<=", ">="} {
-		if comparison == c {
-			double = true
-		}
+	result, ok := value.(bool)
+	if !ok {
+		err := fmt.Errorf("comparison returns a %s instead of a boolean on line %s", typeOfValue(value), lineRaw)
+		return false, err
 	}
-	value1Str = strings.TrimSpace(lineRaw[:i-1])
-	if double {
-		value2Str = strings.TrimSpace(lineRaw[i+2:])
-	} else {
-		value2Str = strings.TrimSpace(lineRaw[i+1:])
+	return result, nil
+}
+
+// PerformArithmeticOperation performs an arithmetic operation with integers
+//
+// Deprecated: attributes are evaluated by ParseNECLFile, this is kept for existing callers
+func PerformArithmeticOperation(lineRaw string, currentAttributes map[string]Attribute) (int, error) {
+	value, err := evaluateExpression(lineRaw, attributeNames(currentAttributes), nil)
+	if err != nil {
+		return 0, err
 	}
 
-	// Check if values are a number or an attribute's name
-	var value1 interface{}
-	var value2 interface{}
+	result, ok := value.(int)
+	if !ok {
+		err := fmt.Errorf("operation returns a %s instead of an integer on line %s", typeOfValue(value), lineRaw)
+		return 0, err
+	}
+	return result, nil
+}
 
-	value1, err := strconv.Atoi(value1Str)
-	if err != nil {
-		// Look for an attribute with this name
-		if currentAttributes[value1Str].Value == nil {
-			err := fmt.Errorf("no attribute named %s was found on line %s", value1Str, lineRaw)
+// membership checks if a value is in a collection
+func membership(value interface{}, collection interface{}) (bool, error) {
+	switch c := collection.(type) {
+	case []interface{}:
+		for _, element := range c {
+			if valuesEqual(value, element) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}, blockGroup:
+		values, _ := asMap(c)
+		key, ok := value.(string)
+		if !ok {
+			err := fmt.Errorf("map keys must be strings, got %s", typeOfValue(value))
+			return false, err
+		}
+		_, found := values[key]
+		return found, nil
+	case string:
+		substring, ok := value.(string)
+		if !ok {
+			err := fmt.Errorf("only strings can be searched in a string, got %s", typeOfValue(value))
 			return false, err
 		}
-		value1 = currentAttributes[value1Str].Value
+		return strings.Contains(c, substring), nil
 	}
 
-	value2, err = strconv.Atoi(value2Str)
-	if err != nil {
-		// Look for an attribute with this name
-		if currentAttributes[value2Str].Value == nil {
-			err := fmt.Errorf("no attribute named %s was found on line %s", value2Str, lineRaw)
-			return false, err
+	err := fmt.Errorf("operator in requires an array, map or string, got %s", typeOfValue(collection))
+	return false, err
+}
+
+// Maximum number of elements of a range, so a file can't allocate unbounded arrays
+const maxRangeLength = 1000000
+
+// numberRange creates an array with all integers from start to end
+// The end is only included on inclusive ranges, and ranges where the start is after the end are empty
+func numberRange(start interface{}, end interface{}, inclusive bool) ([]interface{}, error) {
+	first, ok1 := start.(int)
+	last, ok2 := end.(int)
+	if !ok1 || !ok2 {
+		err := fmt.Errorf("ranges can only be done with integers, got %s and %s", typeOfValue(start), typeOfValue(end))
+		return nil, err
+	}
+	if !inclusive {
+		if last == math.MinInt {
+			return []interface{}{}, nil
 		}
-		value2 = currentAttributes[value2Str].Value
+		last--
+	}
+	if first > last {
+		return []interface{}{}, nil
 	}
 
-	// Transform interfaces in an int
-	if strings.Contains(fmt.Sprintf("%v", value1), ".") || strings.Contains(fmt.Sprintf("%v", value1), ",") {
-		err := errors.New("comparison operations can only be done to integer values")
-		return false, err
+	// The difference is counted as unsigned, so it doesn't overflow on ranges between very large numbers
+	if uint64(last)-uint64(first) >= maxRangeLength {
+		err := fmt.Errorf("range from %d to %d has more than %d elements", first, end, maxRangeLength)
+		return nil, err
 	}
-	if strings.Contains(fmt.Sprintf("%v", value2), ".") || strings.Contains(fmt.Sprintf("%v", value2), ",") {
-		err := errors.New("comparison operations can only be done to integer values")
-		return false, err
+	values := make([]interface{}, last-first+1)
+	for i := range values {
+		values[i] = first + i
 	}
 
-	v1 := value1.(int)
-	v2 := value2.(int)
+	return values, nil
+}
 
-	// Make comparison
-	switch comparison {
-	case "==":
-		return v1 == v2, nil
-	case "!=":
-		return v1 != v2, nil
-	case ">":
-		return v1 > v2, nil
-	case ">=":
-		return v1 >= v2, nil
-	case "<":
-		return v1 < v2, nil
-	case "<=":
-		return v1 <= v2, nil
+// valuesEqual checks if two values are equal, integers and floats with the same value are equal
+func valuesEqual(a interface{}, b interface{}) bool {
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	if okA && okB {
+		return x == y
 	}
 
-	err = fmt.Errorf("unknown error")
-	return false, err
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
 }
 
-// performArithmeticOperation performs an arithmetic operation with integers
-func PerformArithmeticOperation(lineRaw string, currentAttributes map[string]Attribute) (int, error) {
-	// Discover the operation
-	operations := []string{"+", "-", "*", "/"}
-	operation := ""
-	for _, o := range operations {
-		if strings.Contains(lineRaw, o) {
-			operation = o
+// compareValues compares the order of two numbers or two strings
+func compareValues(operator string, a interface{}, b interface{}) (bool, error) {
+	var order int
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	sA, okStrA := a.(string)
+	sB, okStrB := b.(string)
+	switch {
+	case okA && okB:
+		if x < y {
+			order = -1
+		} else if x > y {
+			order = 1
 		}
+	case okStrA && okStrB:
+		order = strings.Compare(sA, sB)
+	default:
+		err := fmt.Errorf("operator %s can't compare %s and %s", operator, typeOfValue(a), typeOfValue(b))
+		return false, err
 	}
-	if operation == "" {
-		err := fmt.Errorf("unknown operator on line: %s", lineRaw)
-		return 0, err
-	}
-
-	// Get values
-	value1Str := ""
-	value2Str := ""
-	i := strings.Index(lineRaw, operation)
-	value1Str = strings.TrimSpace(lineRaw[:i])
-	value2Str = strings.TrimSpace(lineRaw[i+1:])
 
-	// Check if values are a number or an attribute's name
-	var value1Interface interface{}
-	var value2Interface interface{}
-
-	value1Interface, err := strconv.Atoi(value1Str)
-	if err != nil {
-		// Look for an attribute with this name
-		if currentAttributes[value1Str].Value == nil {
-			err := fmt.Errorf("no attribute named %s was found on line %s", value1Str, lineRaw)
-			return 0, err
-		}
-		value1Interface = currentAttributes[value1Str].Value
+	switch operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
 	}
+	return order >= 0, nil
+}
 
-	value2Interface, err = strconv.Atoi(value2Str)
-	if err != nil {
-		// Look for an attribute with this name
-		if currentAttributes[value2Str].Value == nil {
-			err := fmt.Errorf("no attribute named %s was found on line %s", value2Str, lineRaw)
-			return 0, err
+// arithmetic performs an arithmetic operation, the result is an integer if both values are integers
+func arithmetic(operator string, a interface{}, b interface{}) (interface{}, error) {
+	x, okA := a.(int)
+	y, okB := b.(int)
+	if okA && okB {
+		var result int
+		ok := true
+		switch operator {
+		case "+":
+			result, ok = addIntegers(x, y)
+		case "-":
+			result, ok = subtractIntegers(x, y)
+		case "*":
+			result, ok = multiplyIntegers(x, y)
+		case "/", "%":
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if operator == "%" {
+				return x % y, nil
+			}
+			// The only quotient that overflows is the smallest integer divided by -1
+			ok = x != math.MinInt || y != -1
+			result = x / y
+		default:
+			err := fmt.Errorf("unknown operation %s", operator)
+			return nil, err
+		}
+		if !ok {
+			err := fmt.Errorf("overflow, %d %s %d is too large for an integer", x, operator, y)
+			return nil, err
 		}
-		value2Interface = currentAttributes[value2Str].Value
+		return result, nil
 	}
 
-	value1 := value1Interface.(int)
-	value2 := value2Interface.(int)
-
-	// Perform the operation
-	result := 0
-	switch operation {
+	fx, okA := toFloat(a)
+	fy, okB := toFloat(b)
+	if !okA || !okB {
+		err := fmt.Errorf("operator %s requires numbers, got %s and %s", operator, typeOfValue(a), typeOfValue(b))
+		return nil, err
+	}
+	switch operator {
 	case "+":
-		result = value1 + value2
+		return fx + fy, nil
 	case "-":
-		result = value1 - value2
+		return fx - fy, nil
 	case "*":
-		result = value1 * value2
-	case "/":
-		result = value1 / value2
-	default:
-		err := fmt.Errorf("unknown operation %s", operation)
-		return 0, err
+		return fx * fy, nil
+	case "/", "%":
+		if fy == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if operator == "/" {
+			return fx / fy, nil
+		}
+		return math.Mod(fx, fy), nil
 	}
 
-	return result, nil
+	err := fmt.Errorf("unknown operation %s", operator)
+	return nil, err
+}
+
+// toFloat gets the value of a number as a float
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
 }
@@ -4,137 +4,451 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
-// findBlock looks for a block by searching for the beggining '{' and the closing '}'
-func findBlock(data []string, startLine int, currentAttributes map[string]Attribute) (Block, int, []int, int, []int, error) {
-	var start int
-	var end int
-
-	// Declare this as false since blocks can have nested blocks
-	blockStarted := false
-
-	// Nested blocks
-	nestedBlocks := make(map[string]Block)
-	nestedBlockStarts := []int{}
-	nestedBlockEnds := []int{}
-
-	// Try to find where the block starts and where it ends
-	for i, line := range data {
-		// Only start looking when the first byte index is reached
-		if i >= startLine {
-			// Nested block
-			if strings.Contains(line, "{") && blockStarted {
-				// Check if block is nested from another block
-				nested := false
-				for _, val := range nestedBlockStarts {
-					if i == val {
-						nested = true
-					}
-				}
-				if !nested {
-					// This is not the prettiest of stuff and it could definitely see an improvement
-					// but for now, it works
-					newNestedBlock, start, starts, end, ends, err := findBlock(data, i, currentAttributes)
-					if err != nil {
-						return Block{}, 0, nil, 0, nil, err
-					}
-					nestedBlockStarts = append(nestedBlockStarts, start)
-					nestedBlockStarts = append(nestedBlockStarts, starts...)
-					nestedBlockEnds = append(nestedBlockEnds, end)
-					nestedBlockEnds = append(nestedBlockEnds, ends...)
-					nestedBlocks[newNestedBlock.Name] = newNestedBlock
+// body is the content of the file or of a block, as written in the file and before being evaluated
+type body struct {
+	Name       string
+	Labels     []string
+	Line       int
+	Parent     *body
+	Attributes []*attributeDefinition
+	Blocks     []*body
+	Functions  []*userFunction
+	// Template is only set for blocks generated from a collection or included by a condition,
+	// which are expanded before being evaluated
+	Template *blockTemplate
+	// Variables has the loop variables of a generated block
+	Variables map[string]interface{}
+}
+
+// attributeDefinition is an attribute as written in the file, before its value is evaluated
+type attributeDefinition struct {
+	Name  string
+	Value string
+	Line  int
+	Body  *body
+	// Multiline strings are joined while reading the file, so their value is already a string
+	Multiline bool
+	// Local attributes are defined in a locals block, they can be referenced but are not part of the evaluated document
+	Local bool
+}
+
+// bodyParser reads the structure of a file line by line
+type bodyParser struct {
+	lines   []string
+	current int
+}
+
+// parseBody reads attributes and nested blocks until the end of the body
+// The root body ends with the file, all other bodies end with a "}"
+func (p *bodyParser) parseBody(b *body) error {
+	for p.current < len(p.lines) {
+		lineNumber := p.current
+		line := strings.TrimSpace(p.lines[p.current])
+		p.current++
+
+		// Empty lines and comments
+		if line == "" {
+			continue
+		}
+
+		// End of the block
+		if line == "}" {
+			if b.Parent == nil {
+				err := fmt.Errorf("unexpected } on line %d", lineNumber+1)
+				return err
+			}
+			return nil
+		}
+
+		// Function, attributes and blocks can still be named fn, e.g. fn = 1
+		if functionDefinition.MatchString(line) {
+			function, err := parseFunctionDefinition(line, lineNumber)
+			if err != nil {
+				return err
+			}
+			err = addFunction(b, function)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Block
+		if strings.HasSuffix(line, "{") {
+			header := strings.TrimSpace(line[:len(line)-1])
+			var name string
+			var labels []string
+			var template *blockTemplate
+			var err error
+			if strings.HasPrefix(header, "for ") || strings.HasPrefix(header, "if ") {
+				template, err = parseBlockTemplate(header)
+				if template != nil {
+					name = template.Name
 				}
+			} else {
+				name, labels, err = parseBlockHeader(header)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNumber+1, err)
+			}
+			if isReservedName(name) {
+				err := fmt.Errorf("%s is a reserved name and can't be used by a block on line %d", name, lineNumber+1)
+				return err
 			}
 
-			// Look for the start of the block
-			if strings.Contains(line, "{") && !blockStarted {
-				start = i
-				blockStarted = true
+			block := &body{
+				Name:     name,
+				Labels:   labels,
+				Line:     lineNumber,
+				Parent:   b,
+				Template: template,
+			}
+			err = p.parseBody(block)
+			if err != nil {
+				return err
 			}
 
-			// Look for the end of the block
-			if strings.Contains(line, "}") && blockStarted {
-				nested := false
-				for _, val := range nestedBlockEnds {
-					if i == val {
-						nested = true
-					}
+			// Attributes of locals blocks belong to the body around them
+			if name == "locals" {
+				err = addLocals(b, block)
+				if err != nil {
+					return err
 				}
-				if !nested {
-					end = i
-					break
+				continue
+			}
+
+			// Generated blocks are checked when they are expanded
+			if template == nil {
+				err = checkDuplicateBlock(b, block)
+				if err != nil {
+					return err
 				}
 			}
+			b.Blocks = append(b.Blocks, block)
+			continue
+		}
+
+		// Attribute
+		if strings.Contains(line, "=") {
+			attribute, err := p.parseAttribute(line, lineNumber)
+			if err != nil {
+				return err
+			}
+			attribute.Body = b
+
+			err = addAttribute(b, attribute)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := fmt.Errorf("invalid syntax on line %d: %s", lineNumber+1, line)
+		return err
+	}
+
+	if b.Parent != nil {
+		err := fmt.Errorf("block %s on line %d is never closed", b.Name, b.Line+1)
+		return err
+	}
+
+	return nil
+}
+
+// addAttribute adds an attribute definition to a body
+// Attributes are evaluated in the order of their references, so only one value per name is allowed
+func addAttribute(b *body, attribute *attributeDefinition) error {
+	for _, sibling := range b.Attributes {
+		if sibling.Name == attribute.Name {
+			err := fmt.Errorf("duplicate attribute %s on line %d", attribute.Name, attribute.Line+1)
+			return err
 		}
 	}
+	for _, function := range b.Functions {
+		if function.Name == attribute.Name {
+			err := fmt.Errorf("attribute %s on line %d has the same name as a function", attribute.Name, attribute.Line+1)
+			return err
+		}
+	}
+	b.Attributes = append(b.Attributes, attribute)
+	return nil
+}
+
+// addFunction adds a function definition to a body
+// Functions and attributes share the same names, so a function can't have the name of another function or attribute
+func addFunction(b *body, function *userFunction) error {
+	for _, sibling := range b.Functions {
+		if sibling.Name == function.Name {
+			err := fmt.Errorf("duplicate function %s on line %d", function.Name, function.Line+1)
+			return err
+		}
+	}
+	for _, attribute := range b.Attributes {
+		if attribute.Name == function.Name {
+			err := fmt.Errorf("function %s on line %d has the same name as an attribute", function.Name, function.Line+1)
+			return err
+		}
+	}
+	b.Functions = append(b.Functions, function)
+	return nil
+}
 
-	// If a block was found
-	if blockStarted {
-		// Get block name
-		blockNameRaw := strings.TrimSpace(data[start])
-		blockName := strings.TrimSpace(blockNameRaw[:len(blockNameRaw)-1])
+// addLocals adds the attributes of a locals block to the body around it as local attributes
+// Locals share the names of the attributes of that body, so they can't repeat
+func addLocals(b *body, locals *body) error {
+	if len(locals.Labels) > 0 || locals.Template != nil {
+		err := fmt.Errorf("locals block on line %d can't have labels or be generated", locals.Line+1)
+		return err
+	}
+	if len(locals.Blocks) > 0 {
+		err := fmt.Errorf("locals block on line %d can't have nested blocks", locals.Line+1)
+		return err
+	}
 
-		// Get block attributes (if any)
-		blockAttributes, err := findAttributes(data[start:end], currentAttributes)
+	for _, attribute := range locals.Attributes {
+		attribute.Body = b
+		attribute.Local = true
+		err := addAttribute(b, attribute)
 		if err != nil {
-			return Block{}, 0, nil, 0, nil, err
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicateBlock checks if a body already has a block with the same name and labels
+// Blocks are identified by their name and labels, so these can't repeat in the same body
+func checkDuplicateBlock(b *body, block *body) error {
+	key := blockKey(block.Name, block.Labels)
+	for _, sibling := range b.Blocks {
+		if sibling.Template == nil && blockKey(sibling.Name, sibling.Labels) == key {
+			err := fmt.Errorf("duplicate block %s on line %d", key, block.Line+1)
+			return err
 		}
+	}
+	return nil
+}
+
+// parseBlockHeader gets the name and the labels of a block, e.g. backend "api"
+func parseBlockHeader(header string) (string, []string, error) {
+	tokens, err := tokenize(header)
+	if err != nil {
+		return "", nil, err
+	}
 
-		// Knowing where the block starts and ends, a Block struct can be created
-		return Block{
-			Name:       blockName,
-			Attributes: blockAttributes,
-			Blocks:     nestedBlocks,
-		}, start, nestedBlockStarts, end, nestedBlockEnds, nil
+	// Block name
+	if tokens[0].Type != tokenIdentifier {
+		err := fmt.Errorf("invalid block name: %s", header)
+		return "", nil, err
 	}
 
-	// No block was found
-	return Block{}, 0, nil, 0, nil, nil
+	// Labels
+	var labels []string
+	for _, t := range tokens[1:] {
+		if t.Type == tokenEOF {
+			break
+		}
+		if t.Type != tokenString {
+			err := fmt.Errorf("block labels must be strings: %s", header)
+			return "", nil, err
+		}
+		labels = append(labels, t.Text)
+	}
+
+	return tokens[0].Text, labels, nil
 }
 
-// findAttributesNoBlock looks for attributes that are outside blocks
-func findAttributesNoBlock(data []string) (map[string]Attribute, error) {
-	// Declare this to know when line is inside a block
-	blockStarted := false
+// parseAttribute reads an attribute definition, following multiline strings and arrays to their last line
+func (p *bodyParser) parseAttribute(line string, lineNumber int) (*attributeDefinition, error) {
+	// Find position of the '='
+	i := strings.Index(line, "=")
+
+	// Get attribute name
+	attributeName := strings.TrimSpace(line[:i])
+
+	// Name cannot be empty
+	if attributeName == "" {
+		err := fmt.Errorf("attribute name cannot be empty on line %d", lineNumber+1)
+		return nil, err
+	}
+	if isReservedName(attributeName) {
+		err := fmt.Errorf("%s is a reserved name and can't be used by an attribute on line %d", attributeName, lineNumber+1)
+		return nil, err
+	}
+
+	attribute := &attributeDefinition{
+		Name:  attributeName,
+		Value: strings.TrimSpace(line[i+1:]),
+		Line:  lineNumber,
+	}
+
+	// Multiline string, every line ends with a `\` except for the last one
+	if strings.HasSuffix(attribute.Value, `\`) {
+		var stringLines []string
+		value := attribute.Value
+		for {
+			// Add lines to the array (already trimmed)
+			removeBackslash := strings.TrimSpace(strings.TrimSuffix(value, `\`))
+			if len(removeBackslash) < 2 {
+				err := fmt.Errorf("invalid multiline string on line %d", lineNumber+1)
+				return nil, err
+			}
+			stringLines = append(stringLines, removeBackslash[1:len(removeBackslash)-1])
 
-	// Declare an empty map of attributes
-	attributes := make(map[string]Attribute)
+			// If the line doesn't have a `\`, it means that it is the last line of the multiline string
+			if !strings.HasSuffix(value, `\`) {
+				break
+			}
 
-	// Try to find if there's any block
-	for i, line := range data {
-		// Look for the start of a block
-		if strings.Contains(line, "{") && !blockStarted {
-			blockStarted = true
+			value = p.nextLine()
+			if value == "" {
+				err := fmt.Errorf("multiline string on line %d is never closed", lineNumber+1)
+				return nil, err
+			}
 		}
 
-		// Look for the end of a block
-		if strings.Contains(line, "}") && blockStarted {
-			blockStarted = false
+		attribute.Value = strings.Join(stringLines, " ")
+		attribute.Multiline = true
+		return attribute, nil
+	}
+
+	// Multiline array, lines are joined until all brackets are closed
+	if strings.HasPrefix(attribute.Value, "[") {
+		arrayLines := []string{attribute.Value}
+		depth := bracketDepth(attribute.Value)
+		for depth > 0 {
+			value := p.nextLine()
+			if value == "" {
+				err := fmt.Errorf("array on line %d is never closed", lineNumber+1)
+				return nil, err
+			}
+			arrayLines = append(arrayLines, value)
+			depth += bracketDepth(value)
 		}
+		attribute.Value = strings.Join(arrayLines, " ")
+	}
 
-		// Skip looking for attributes if inside a block
-		if blockStarted {
-			continue
+	return attribute, nil
+}
+
+// nextLine gets the next line that is not empty, or an empty string at the end of the file
+func (p *bodyParser) nextLine() string {
+	for p.current < len(p.lines) {
+		line := strings.TrimSpace(p.lines[p.current])
+		p.current++
+		if line != "" {
+			return line
 		}
+	}
+	return ""
+}
 
-		// If not inside a block, look for attributes
-		found, newAttr, err := findAttribute(data, i, attributes)
-		if err != nil {
-			return nil, err
+// bracketDepth counts how many brackets a line opens and doesn't close, ignoring strings
+func bracketDepth(line string) int {
+	depth := 0
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+// removeComment removes a line or inline comment from a line, ignoring "//" inside strings
+func removeComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(line[i:], "//"):
+			return strings.TrimRight(line[:i], " \t")
 		}
-		if found && (newAttr.Name != "") {
-			attributes[newAttr.Name] = Attribute{
-				Name:  newAttr.Name,
-				Type:  newAttr.Type,
-				Value: newAttr.Value,
-				Array: newAttr.Array,
+	}
+	return line
+}
+
+// evaluateDocument calculates the values of all attributes of a document
+// Attributes are evaluated after the attributes they reference, so they can be written in any order
+func evaluateDocument(root *body, functions *FunctionRegistry) (map[string]Attribute, map[string]Block, error) {
+	// Attributes evaluated to expand templates are kept, so every attribute is only evaluated once
+	evaluated := make(map[*attributeDefinition]Attribute)
+	err := expandTemplates(root, functions, evaluated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopes := make(map[*body]*scope)
+	rootScope := newScope(root, nil, scopes)
+
+	order, err := newDependencyGraph(root).order()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = evaluateAttributes(order, scopes, functions, evaluated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rootScope.attributes, rootScope.nestedBlocks(), nil
+}
+
+// evaluateAttributes calculates the values of attributes in the given order and stores them in the scopes of their bodies
+// Attributes that are already in evaluated keep their value, new values are added to it
+func evaluateAttributes(order []*attributeDefinition, scopes map[*body]*scope, functions *FunctionRegistry, evaluated map[*attributeDefinition]Attribute) error {
+	for _, definition := range order {
+		attribute, found := evaluated[definition]
+		switch {
+		case found:
+			// Evaluated while expanding a template
+		case definition.Multiline:
+			attribute = Attribute{
+				Name:  definition.Name,
+				Type:  "string",
+				Value: definition.Value,
+				Array: []interface{}{},
+			}
+		default:
+			var err error
+			attribute, err = getAttribute(definition.Name, definition.Value, scopes[definition.Body], functions)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", definition.Line+1, err)
 			}
 		}
+		evaluated[definition] = attribute
+
+		if definition.Local {
+			scopes[definition.Body].locals[definition.Name] = attribute
+		} else {
+			scopes[definition.Body].setAttribute(attribute)
+		}
 	}
 
-	return attributes, nil
+	return nil
+}
+
+// blockKey is the key of a block in the Blocks map, its name followed by its labels, e.g. backend.api
+func blockKey(name string, labels []string) string {
+	return strings.Join(append([]string{name}, labels...), ".")
 }
 
 // This reads a file as an array of bytes
@@ -177,8 +491,87 @@ func readFile(filename string) ([]string, error) {
 	return rawData, nil
 }
 
+// parseConfig has the settings used to parse a file
+type parseConfig struct {
+	functions *FunctionRegistry
+	// Directory that the file functions can read from, any file can be read if empty
+	allowedRoot string
+	// Environment variables that env can read, any variable can be read if nil
+	allowedEnv map[string]bool
+	// Environment used by env instead of the one of the process, if not nil
+	env map[string]string
+}
+
+// ParseOption changes how a file is parsed
+type ParseOption func(config *parseConfig)
+
+// WithFunctions makes the functions of a registry callable from the parsed file, instead of only the built-in functions
+func WithFunctions(registry *FunctionRegistry) ParseOption {
+	return func(config *parseConfig) {
+		config.functions = registry
+	}
+}
+
+// WithAllowedRoot only lets the file functions read files inside a directory and its subdirectories
+// Without it files can only be read inside the directory of the parsed file
+func WithAllowedRoot(dir string) ParseOption {
+	return func(config *parseConfig) {
+		config.allowedRoot = dir
+	}
+}
+
+// WithAllowedEnv lets env read some environment variables, reading any other variable is an error
+// Without it env can only read the variables given with WithEnv
+func WithAllowedEnv(names ...string) ParseOption {
+	return func(config *parseConfig) {
+		config.allowedEnv = make(map[string]bool)
+		for _, name := range names {
+			config.allowedEnv[name] = true
+		}
+	}
+}
+
+// WithEnv makes env read variables from a map instead of the environment of the process, e.g. to get the same result in tests
+func WithEnv(env map[string]string) ParseOption {
+	return func(config *parseConfig) {
+		config.env = make(map[string]string)
+		for name, value := range env {
+			config.env[name] = value
+		}
+	}
+}
+
+// forParse gets a registry where the built-in functions that depend on the parse use its settings
+// File functions read paths relative to dir, and only inside it unless another root is allowed
+// Functions with the same names registered by applications are kept
+func (config *parseConfig) forParse(dir string) *FunctionRegistry {
+	bound := config.functions.clone()
+
+	settings := &FunctionRegistry{
+		functions:      make(map[string]Function),
+		parseFunctions: make(map[string]bool),
+	}
+	root := config.allowedRoot
+	if root == "" {
+		root = dir
+	}
+	registerFileFunctions(settings, fileAccess{dir: dir, root: root, functions: bound})
+	registerEnvFunctions(settings, envAccess{allowed: config.allowedEnv, values: config.env})
+	for name := range config.functions.parseFunctions {
+		bound.functions[name] = settings.functions[name]
+	}
+	return bound
+}
+
 // ParseNECLFile will read and parse a ".necl" file
-func ParseNECLFile(filename string) (*File, error) {
+func ParseNECLFile(filename string, options ...ParseOption) (*File, error) {
+	config := &parseConfig{
+		functions: defaultFunctions,
+	}
+	for _, option := range options {
+		option(config)
+	}
+
 	// Read file
 	rawText, err := readFile(filename)
 	if err != nil {
@@ -186,65 +579,24 @@ func ParseNECLFile(filename string) (*File, error) {
 	}
 
 	// Remove all comments from the text
+	// Lines are kept (even if empty) so line numbers on errors match the file
 	for i, line := range rawText {
-		// Break if last line was reached
-		// This is needed because this loop should run for the entire length of the text
-		// But if comments are being removed, the length of the text is going to be dinamically reduced
-		// This is set so no index out of bound errors happen
-		if i > len(rawText) {
-			break
-		}
-		// Line comment
-		if strings.HasPrefix(strings.TrimSpace(line), "//") {
-			if i == len(rawText)-1 {
-				rawText = rawText[:i-1]
-			} else {
-				rawText = append(rawText[:i], rawText[i+1:]...)
-			}
-		} else if strings.Contains(strings.TrimSpace(line), "//") { // Inline comment
-			// Find index of where the comments start
-			firstSlash := 0
-			foundComment := false
-			for j, c := range line {
-				if string(c) == "/" && firstSlash == 0 && !foundComment {
-					firstSlash = j
-				}
-				if j == firstSlash && string(c) != "/" && !foundComment {
-					firstSlash = 0
-				}
-				if string(c) == "/" && firstSlash != 0 && !foundComment {
-					foundComment = true
-				}
-			}
-			rawText[i] = line[:firstSlash-1]
-		}
+		rawText[i] = removeComment(line)
 	}
 
-	// Find attributes that are not inside blocks
-	attributes, err := findAttributesNoBlock(rawText)
+	// Read the structure of the file
+	parser := &bodyParser{lines: rawText}
+	root := &body{}
+	err = parser.parseBody(root)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find blocks
-	blocks := make(map[string]Block)
-	startLine := 0
-	for startLine < len(rawText) {
-		newBlock, _, _, endLine, _, err := findBlock(rawText, startLine, attributes)
-		if err != nil {
-			return nil, err
-		}
-
-		if newBlock.Name != "" {
-			// Add new block to the array of blocks
-			blocks[newBlock.Name] = newBlock
-		}
-
-		if endLine == 0 {
-			startLine += 1
-		} else {
-			startLine = endLine - 1
-		}
+	// Evaluate attributes and blocks, file functions read paths relative to the parsed file
+	functions := config.forParse(filepath.Dir(filename))
+	attributes, blocks, err := evaluateDocument(root, functions)
+	if err != nil {
+		return nil, err
 	}
 
 	return &File{
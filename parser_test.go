@@ -1,6 +1,12 @@
 package necl
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -110,6 +116,19 @@ func TestConditions(t *testing.T) {
 	assert.EqualValues(t, []interface{}{1, 4, 9, 16, 25}, file.Attributes["arrayForMath1"].Array)
 	assert.EqualValues(t, []interface{}{true, false, true, false, true}, file.Attributes["arrayForLogic1"].Array)
 	assert.EqualValues(t, []interface{}{false, true, false, true, false}, file.Attributes["arrayForLogic2"].Array)
+
+	// Deprecated functions
+	attributes := map[string]Attribute{"port": valueToAttribute("port", 80)}
+	comparison, err := PerformComparison("port >= 80", attributes)
+	assert.NoError(t, err)
+	assert.True(t, comparison)
+	_, err = PerformComparison("port + 1", attributes)
+	assert.EqualError(t, err, "comparison returns a number instead of a boolean on line port + 1")
+	result, err := PerformArithmeticOperation("port * 2", attributes)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 160, result)
+	_, err = PerformArithmeticOperation("port / 2.5", attributes)
+	assert.EqualError(t, err, "operation returns a number instead of an integer on line port / 2.5")
 }
 
 func TestK8sNECLFileParser(t *testing.T) {
@@ -131,3 +150,892 @@ func TestK8sNECLFileParser(t *testing.T) {
 	assert.EqualValues(t, "nginx:1.14.2", file.Blocks["spec"].Blocks["template"].Blocks["spec"].Blocks["containers"].Blocks["nginx"].Attributes["image"].Value)
 	assert.EqualValues(t, 80, file.Blocks["spec"].Blocks["template"].Blocks["spec"].Blocks["containers"].Blocks["nginx"].Blocks["ports"].Attributes["containerPort"].Value)
 }
+
+func TestIndexAndSlice(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-5-test-indexing.necl")
+	assert.NoError(t, err)
+
+	// Arrays
+	assert.EqualValues(t, 80, file.Attributes["firstPort"].Value)
+	assert.EqualValues(t, 9090, file.Attributes["lastPort"].Value)
+	assert.EqualValues(t, []interface{}{443, 8080}, file.Attributes["somePorts"].Array)
+	assert.EqualValues(t, []interface{}{80, 443}, file.Attributes["headPorts"].Array)
+	assert.EqualValues(t, []interface{}{8080, 9090}, file.Attributes["tailPorts"].Array)
+	assert.EqualValues(t, "b", file.Attributes["literalIndex"].Value)
+	assert.EqualValues(t, []interface{}{80, 9090}, file.Attributes["indexes"].Array)
+
+	// Strings
+	assert.EqualValues(t, "nginx", file.Attributes["shortName"].Value)
+	assert.EqualValues(t, "n", file.Attributes["firstLetter"].Value)
+	assert.EqualValues(t, "t", file.Attributes["lastLetter"].Value)
+	assert.EqualValues(t, "deployment", file.Attributes["suffix"].Value)
+
+	// Maps
+	attributes := map[string]Attribute{
+		"labels": {Name: "labels", Type: "map", Value: map[string]interface{}{"app": "nginx"}},
+	}
+	result, err := evaluateExpression(`labels["app"]`, attributeNames(attributes), nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "nginx", result)
+
+	// Errors point at the invalid index
+	_, err = evaluateExpression("ports[4]", attributeNames(file.Attributes), nil)
+	assert.EqualError(t, err, "index 4 out of range for array of length 4 at column 7 of: ports[4]")
+	_, err = evaluateExpression("ports[-5]", attributeNames(file.Attributes), nil)
+	assert.EqualError(t, err, "index -5 out of range for array of length 4 at column 7 of: ports[-5]")
+	_, err = evaluateExpression("name[3:40]", attributeNames(file.Attributes), nil)
+	assert.EqualError(t, err, "slice bound 40 out of range for length 16 at column 8 of: name[3:40]")
+	_, err = evaluateExpression(`labels["web"]`, attributeNames(attributes), nil)
+	assert.EqualError(t, err, `key "web" not found in map at column 8 of: labels["web"]`)
+}
+
+func TestQualifiedReferences(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-6-test-references.necl")
+	assert.NoError(t, err)
+
+	// Block attributes don't overwrite global attributes with the same name
+	assert.EqualValues(t, "global", file.Attributes["name"].Value)
+	assert.EqualValues(t, "nginx-deployment", file.Blocks["metadata"].Attributes["name"].Value)
+	assert.NotContains(t, file.Attributes, "app")
+
+	// References to other blocks
+	assert.EqualValues(t, "nginx", file.Blocks["spec"].Attributes["app"].Value)
+	assert.EqualValues(t, "nginx-deployment", file.Blocks["spec"].Attributes["deploymentName"].Value)
+	assert.EqualValues(t, map[string]interface{}{"app": "nginx", "tier": "frontend"}, file.Blocks["spec"].Attributes["labels"].Value)
+	assert.EqualValues(t, "frontend", file.Blocks["spec"].Attributes["tier"].Value)
+
+	// Labeled blocks
+	assert.EqualValues(t, "backend", file.Blocks["backend.api"].Name)
+	assert.EqualValues(t, []string{"api"}, file.Blocks["backend.api"].Labels)
+	assert.EqualValues(t, "10.0.0.1", file.Blocks["proxy"].Attributes["upstream"].Value)
+	assert.EqualValues(t, 443, file.Blocks["proxy"].Attributes["upstreamPort"].Value)
+	assert.EqualValues(t, "10.0.0.2", file.Blocks["proxy"].Attributes["fallback"].Value)
+
+	// Qualified references inside operations
+	assert.EqualValues(t, 81, file.Blocks["proxy"].Attributes["nextPort"].Value)
+	assert.EqualValues(t, true, file.Blocks["proxy"].Attributes["isFrontend"].Value)
+	assert.EqualValues(t, "http://10.0.0.1:80", file.Blocks["proxy"].Attributes["url"].Value)
+}
+
+// parseTestFile writes a NECL file to a temporary directory and parses it
+func parseTestFile(t *testing.T, content string, options ...ParseOption) (*File, error) {
+	filename := filepath.Join(t.TempDir(), "test.necl")
+	err := os.WriteFile(filename, []byte(content), 0600)
+	assert.NoError(t, err)
+
+	return ParseNECLFile(filename, options...)
+}
+
+func TestScopes(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-7-test-scopes.necl")
+	assert.NoError(t, err)
+
+	// Inner attributes shadow outer ones without overwriting them
+	assert.EqualValues(t, 80, file.Attributes["port"].Value)
+	assert.EqualValues(t, 8080, file.Blocks["server"].Attributes["port"].Value)
+	assert.EqualValues(t, 8080, file.Blocks["server"].Attributes["localPort"].Value)
+	assert.EqualValues(t, "eu", file.Blocks["server"].Attributes["inherited"].Value)
+	assert.EqualValues(t, 9090, file.Blocks["server"].Blocks["listener"].Attributes["innerPort"].Value)
+	assert.Len(t, file.Attributes, 3)
+
+	// self, parent and root
+	assert.EqualValues(t, 80, file.Blocks["server"].Attributes["globalPort"].Value)
+	assert.EqualValues(t, 8080, file.Blocks["server"].Attributes["selfPort"].Value)
+	assert.EqualValues(t, 8080, file.Blocks["server"].Blocks["listener"].Attributes["outerPort"].Value)
+	assert.EqualValues(t, "global", file.Blocks["server"].Blocks["listener"].Attributes["serverName"].Value)
+	assert.EqualValues(t, "client", file.Blocks["client"].Attributes["fullName"].Value)
+
+	// self, parent and root inside operations
+	assert.EqualValues(t, 8081, file.Blocks["server"].Attributes["nextPort"].Value)
+	assert.EqualValues(t, true, file.Blocks["server"].Attributes["isGlobal"].Value)
+	assert.EqualValues(t, 1010, file.Blocks["server"].Blocks["listener"].Attributes["portOffset"].Value)
+
+	// Sibling blocks
+	assert.EqualValues(t, 8080, file.Blocks["client"].Attributes["port"].Value)
+	_, err = parseTestFile(t, "a {\n    x = 1\n}\nb {\n    y = x\n}\n")
+	assert.EqualError(t, err, "line 5: no attribute named x was found at column 1 of: x")
+
+	// Reserved names
+	_, err = parseTestFile(t, "self = 1\n")
+	assert.EqualError(t, err, "self is a reserved name and can't be used by an attribute on line 1")
+	_, err = parseTestFile(t, "x = parent.y\n")
+	assert.EqualError(t, err, "line 1: no attribute named parent was found at column 1 of: parent.y")
+}
+
+func TestEvaluationOrder(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-8-test-order.necl")
+	assert.NoError(t, err)
+
+	// Forward references
+	assert.EqualValues(t, 43, file.Attributes["total"].Value)
+	assert.EqualValues(t, 3, file.Attributes["replicas"].Value)
+	assert.EqualValues(t, "nginx 1.14.2", file.Attributes["image"].Value)
+	assert.EqualValues(t, 3, file.Blocks["spec"].Attributes["replicas"].Value)
+
+	// Reference cycles
+	_, err = parseTestFile(t, "a = b\nb = c\nc = a\n")
+	assert.EqualError(t, err, "reference cycle on line 1: a -> b -> c -> a")
+	_, err = parseTestFile(t, "port = server.port\nserver {\n    port = listener.port\n    listener {\n        port = root.port\n    }\n}\n")
+	assert.EqualError(t, err, "reference cycle on line 1: port -> server.port -> server.listener.port -> port")
+	_, err = parseTestFile(t, "a = self\n")
+	assert.EqualError(t, err, "reference cycle on line 1: a -> a")
+
+	// Duplicate attributes
+	_, err = parseTestFile(t, "a = 1\na = 2\n")
+	assert.EqualError(t, err, "duplicate attribute a on line 2")
+}
+
+func TestSplat(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-9-test-splat.necl")
+	assert.NoError(t, err)
+
+	// Repeated blocks
+	assert.EqualValues(t, []interface{}{"10.0.0.1", "10.0.0.2"}, file.Attributes["addresses"].Array)
+	assert.EqualValues(t, []interface{}{8080, 80}, file.Attributes["firstPorts"].Array)
+	assert.EqualValues(t, []interface{}{[]interface{}{8080, 8443}, []interface{}{80, 443}}, file.Attributes["attributePorts"].Array)
+	assert.EqualValues(t, []interface{}{8080, 8443}, file.Attributes["firstAttributePorts"].Array)
+	assert.EqualValues(t, 8081, file.Attributes["nextPort"].Value)
+	assert.EqualValues(t, 4, file.Attributes["backendCount"].Value)
+
+	// Arrays
+	assert.EqualValues(t, []interface{}{"10.0.0.2", "10.0.0.1"}, file.Attributes["serverAddresses"].Array)
+	assert.EqualValues(t, []interface{}{[]interface{}{80, 443}, []interface{}{8080, 8443}}, file.Attributes["serverPorts"].Array)
+
+	// Null and single values
+	assert.EqualValues(t, []interface{}{}, file.Attributes["noAddresses"].Array)
+	assert.EqualValues(t, []interface{}{"10.0.0.2"}, file.Attributes["single"].Array)
+}
+
+func TestMembershipAndRanges(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-10-test-membership.necl")
+	assert.NoError(t, err)
+
+	// Membership
+	assert.EqualValues(t, true, file.Attributes["isAllowedEnv"].Value)
+	assert.EqualValues(t, true, file.Attributes["isAllowedPort"].Value)
+	assert.EqualValues(t, false, file.Attributes["isLiteralPort"].Value)
+	assert.EqualValues(t, true, file.Attributes["hasAppLabel"].Value)
+	assert.EqualValues(t, false, file.Attributes["hasTierLabel"].Value)
+	assert.EqualValues(t, true, file.Attributes["isSubstring"].Value)
+	assert.EqualValues(t, true, file.Attributes["isCombined"].Value)
+
+	// Ranges
+	assert.EqualValues(t, []interface{}{0, 1, 2, 3, 4}, file.Attributes["exclusive"].Array)
+	assert.EqualValues(t, []interface{}{1, 2, 3}, file.Attributes["inclusive"].Array)
+	assert.EqualValues(t, []interface{}{}, file.Attributes["emptyRange"].Array)
+	assert.EqualValues(t, true, file.Attributes["isInRange"].Value)
+	assert.EqualValues(t, []interface{}{0, 2, 4, 6}, file.Attributes["doubled"].Array)
+
+	// Ranges at the limits of integers and long ranges
+	file, err = parseTestFile(t, "a = 9223372036854775807..=9223372036854775807\nb = 0..(-9223372036854775807 - 1)\n")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []interface{}{math.MaxInt}, file.Attributes["a"].Array)
+	assert.EqualValues(t, []interface{}{}, file.Attributes["b"].Array)
+	_, err = parseTestFile(t, "x = 0..=9223372036854775807\n")
+	assert.EqualError(t, err, "line 1: range from 0 to 9223372036854775807 has more than 1000000 elements at column 2 of: 0..=9223372036854775807")
+	_, err = parseTestFile(t, "x = 0..1000000000\n")
+	assert.EqualError(t, err, "line 1: range from 0 to 1000000000 has more than 1000000 elements at column 2 of: 0..1000000000")
+
+	// Invalid collections
+	_, err = parseTestFile(t, "a = 1 in 2\n")
+	assert.EqualError(t, err, "line 1: operator in requires an array, map or string, got number at column 3 of: 1 in 2")
+}
+
+func TestIfExpressions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-11-test-conditionals.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "nginx:1.14.2", file.Attributes["image"].Value)
+	assert.EqualValues(t, "silver", file.Attributes["tier"].Value)
+	assert.EqualValues(t, "medium", file.Attributes["size"].Value)
+	assert.EqualValues(t, 2, file.Attributes["nested"].Value)
+	assert.EqualValues(t, 4, file.Attributes["scaled"].Value)
+	assert.EqualValues(t, 443, file.Attributes["firstPort"].Value)
+	assert.EqualValues(t, []interface{}{80, 443}, file.Attributes["allPorts"].Array)
+	assert.EqualValues(t, "STAGING", file.Attributes["greeting"].Value)
+
+	// Conditions must be booleans
+	_, err = parseTestFile(t, "a = if 1 ? 2 : 3\n")
+	assert.EqualError(t, err, "line 1: condition must be a boolean, got number at column 4 of: if 1 ? 2 : 3")
+	_, err = parseTestFile(t, "a = if true ? 2\n")
+	assert.EqualError(t, err, "line 1: unexpected end of expression at column 12 of: if true ? 2")
+}
+
+func TestForExpressions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-12-test-for.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, []interface{}{160, 886, 16160}, file.Attributes["doubled"].Array)
+	assert.EqualValues(t, []interface{}{80, 444, 8082}, file.Attributes["named"].Array)
+	assert.EqualValues(t, []interface{}{80, 443, 8080}, file.Attributes["values"].Array)
+	assert.EqualValues(t, []interface{}{443, 8080}, file.Attributes["securePorts"].Array)
+	assert.EqualValues(t, []interface{}{0, 2}, file.Attributes["evenIndexes"].Array)
+	assert.EqualValues(t, []interface{}{"app", "tier"}, file.Attributes["labelKeys"].Array)
+	assert.EqualValues(t, []interface{}{"NGINX", "FRONTEND"}, file.Attributes["labelValues"].Array)
+	assert.EqualValues(t, []interface{}{"10.0.0.1", "10.0.0.2"}, file.Attributes["addresses"].Array)
+	assert.EqualValues(t, map[string]interface{}{"nginx": "app", "frontend": "tier"}, file.Attributes["labelNames"].Value)
+	assert.EqualValues(t, map[string]interface{}{"app": "NGINX", "tier": "FRONTEND"}, file.Attributes["upperLabels"].Value)
+	assert.EqualValues(t, map[string]interface{}{"api": "10.0.0.1"}, file.Attributes["backendAddresses"].Value)
+	assert.EqualValues(t, 100, file.Attributes["outside"].Value)
+
+	// Deprecated function
+	values, err := ForExpression("for v in ports : v * 2", map[string]Attribute{"ports": valueToAttribute("ports", []interface{}{80, 443})})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []interface{}{160, 886}, values)
+	_, err = ForExpression(`for v in ["a"] : v => 1`, nil)
+	assert.EqualError(t, err, `for expression creates a map instead of an array on for v in ["a"] : v => 1`)
+
+	// Invalid loops
+	_, err = parseTestFile(t, "a = for i, i in [1] : i\n")
+	assert.EqualError(t, err, "line 1: loop variables must have different names at column 8 of: for i, i in [1] : i")
+	_, err = parseTestFile(t, "a = for v in 1 : v\n")
+	assert.EqualError(t, err, "line 1: a 'for' expression requires an array or a map, got number at column 10 of: for v in 1 : v")
+	_, err = parseTestFile(t, "a = for v in [1, 2] : v if v\n")
+	assert.EqualError(t, err, "line 1: filter must be a boolean, got number at column 24 of: for v in [1, 2] : v if v")
+	_, err = parseTestFile(t, "a = for v in [\"a\", \"a\"] : v => 1\n")
+	assert.EqualError(t, err, "line 1: duplicate key \"a\" at column 23 of: for v in [\"a\", \"a\"] : v => 1")
+}
+
+func TestGeneratedBlocks(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-13-test-dynamic.necl")
+	assert.NoError(t, err)
+
+	// Arrays
+	assert.EqualValues(t, []string{"node", "0"}, file.Blocks["backend.node.0"].Labels)
+	assert.EqualValues(t, "10.0.0.1", file.Blocks["backend.node.0"].Attributes["address"].Value)
+	assert.EqualValues(t, 8000, file.Blocks["backend.node.0"].Attributes["port"].Value)
+	assert.EqualValues(t, "10.0.0.2", file.Blocks["backend.node.1"].Attributes["address"].Value)
+	assert.EqualValues(t, 8001, file.Blocks["backend.node.1"].Attributes["port"].Value)
+
+	// Maps and nested generated blocks
+	assert.EqualValues(t, 8080, file.Blocks["listener.api"].Attributes["port"].Value)
+	assert.EqualValues(t, false, file.Blocks["listener.api"].Attributes["public"].Value)
+	assert.EqualValues(t, true, file.Blocks["listener.web"].Attributes["public"].Value)
+	assert.EqualValues(t, "web", file.Blocks["listener.web"].Blocks["route.https"].Attributes["target"].Value)
+	assert.Len(t, file.Blocks["listener.api"].Blocks, 2)
+
+	// References
+	assert.EqualValues(t, []interface{}{"10.0.0.1", "10.0.0.2"}, file.Attributes["addresses"].Array)
+	assert.EqualValues(t, 80, file.Attributes["webPort"].Value)
+	assert.EqualValues(t, "10.0.0.1", file.Attributes["firstAddress"].Value)
+	assert.EqualValues(t, 8002, file.Attributes["secondPort"].Value)
+
+	// Invalid templates
+	_, err = parseTestFile(t, "for v in 1 : block v {\n}\n")
+	assert.EqualError(t, err, "line 1: a 'for' block requires an array or a map, got number at column 10 of: for v in 1 : block v")
+	_, err = parseTestFile(t, "for v in [true] : block v {\n}\n")
+	assert.EqualError(t, err, "line 1: block labels must be strings or numbers, got boolean at column 25 of: for v in [true] : block v")
+	_, err = parseTestFile(t, "for v in [\"a\", \"a\"] : block v {\n}\n")
+	assert.EqualError(t, err, "duplicate block block.a on line 1")
+
+	// Attributes used by several templates are only evaluated once
+	calls := 0
+	registry := NewFunctionRegistry()
+	err = registry.Register(Function{
+		Name:       "tracked",
+		Parameters: []Parameter{{Name: "value", Type: TypeAny}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			calls++
+			return args[0], nil
+		},
+	})
+	assert.NoError(t, err)
+	content := "names = tracked([\"a\", \"b\"])\nfor name in names : server name {\n}\nfor name in names : client name {\n    for other in names : peer other {\n    }\n}\n"
+	file, err = parseTestFile(t, content, WithFunctions(registry))
+	assert.NoError(t, err)
+	assert.Len(t, file.Blocks["client.b"].Blocks, 2)
+	assert.Equal(t, 1, calls)
+}
+
+func TestConditionalBlocks(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-14-test-conditional-blocks.necl")
+	assert.NoError(t, err)
+
+	server := file.Blocks["server"]
+	assert.EqualValues(t, "server.crt", server.Blocks["tls"].Attributes["certificate"].Value)
+	assert.EqualValues(t, 80, server.Blocks["tls"].Blocks["redirect"].Attributes["from"].Value)
+	assert.NotContains(t, server.Blocks, "debug")
+	assert.Len(t, server.Blocks, 1)
+
+	assert.EqualValues(t, "eu", file.Blocks["cluster.eu"].Blocks["backup.daily"].Attributes["target"].Value)
+	assert.Empty(t, file.Blocks["cluster.us"].Blocks)
+	assert.EqualValues(t, "server.crt", file.Attributes["hasTLS"].Value)
+
+	// Conditions must be booleans
+	_, err = parseTestFile(t, "if 1 : block {\n}\n")
+	assert.EqualError(t, err, "line 1: condition must be a boolean, got number at column 4 of: if 1 : block")
+
+	// Blocks that are not included can't be referenced
+	_, err = parseTestFile(t, "if false : block {\na = 1\n}\nb = block.a\n")
+	assert.EqualError(t, err, "line 4: no attribute named block was found at column 1 of: block.a")
+}
+
+func TestLocals(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-15-test-locals.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, 8001, file.Attributes["apiPort"].Value)
+	assert.EqualValues(t, "APP", file.Attributes["apiName"].Value)
+	assert.EqualValues(t, 9010, file.Blocks["server"].Attributes["port"].Value)
+	assert.EqualValues(t, 8001, file.Blocks["server"].Attributes["outer"].Value)
+	assert.EqualValues(t, 8001, file.Blocks["worker.b"].Attributes["port"].Value)
+	assert.EqualValues(t, 8001, file.Attributes["copy"].Value)
+
+	// Locals are not part of the document
+	for _, name := range []string{"base_port", "prefix", "last"} {
+		assert.NotContains(t, file.Attributes, name)
+	}
+	assert.Len(t, file.Blocks["server"].Attributes, 2)
+	assert.Len(t, file.Blocks["worker.a"].Attributes, 1)
+	assert.NotContains(t, file.Blocks, "locals")
+
+	// Locals share the names of the attributes around them
+	_, err = parseTestFile(t, "a = 1\nlocals {\na = 2\n}\n")
+	assert.EqualError(t, err, "duplicate attribute a on line 3")
+	_, err = parseTestFile(t, "locals {\nblock {\n}\n}\n")
+	assert.EqualError(t, err, "locals block on line 1 can't have nested blocks")
+}
+
+func TestUserFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-16-test-user-functions.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, 8020, file.Attributes["port"].Value)
+	assert.EqualValues(t, []interface{}{8000, 8010, 8020}, file.Attributes["ports"].Array)
+	assert.EqualValues(t, 16021, file.Attributes["scaled"].Value)
+	assert.EqualValues(t, 120, file.Attributes["factorial"].Value)
+	assert.EqualValues(t, "HELLO", file.Attributes["greeting"].Value)
+	assert.EqualValues(t, []interface{}{8000, 6}, file.Attributes["withFunctions"].Array)
+	assert.EqualValues(t, 9001, file.Blocks["server"].Attributes["port"].Value)
+	assert.EqualValues(t, 18002, file.Blocks["server"].Attributes["double"].Value)
+
+	// Functions are not part of the document
+	assert.NotContains(t, file.Attributes, "port_for")
+
+	// Attributes and blocks named fn
+	assert.EqualValues(t, 1, file.Attributes["fn"].Value)
+	assert.EqualValues(t, "block", file.Blocks["fn"].Attributes["name"].Value)
+	assert.EqualValues(t, 2, file.Attributes["fnValue"].Value)
+
+	// Arity and recursion
+	_, err = parseTestFile(t, "fn f(a) = a\nx = f(1, 2)\n")
+	assert.EqualError(t, err, "line 2: function f expects 1 argument, got 2 at column 6 of: f(1, 2)")
+	_, err = parseTestFile(t, "fn loop(n) = loop(n + 1)\nx = loop(1)\n")
+	assert.EqualError(t, err, "line 2: function loop exceeded the maximum call depth of 64 at column 1 of: loop(n + 1)")
+
+	// Functions only see their parameters
+	_, err = parseTestFile(t, "y = 1\nfn f(a) = a + y\nx = f(1)\n")
+	assert.EqualError(t, err, "line 3: no attribute named y was found at column 5 of: a + y")
+
+	// Invalid definitions
+	_, err = parseTestFile(t, "fn if(a) = a\n")
+	assert.EqualError(t, err, "line 1: invalid function name: if")
+	_, err = parseTestFile(t, "fn f(a, a) = a\n")
+	assert.EqualError(t, err, "line 1: duplicate parameter a in function f")
+	_, err = parseTestFile(t, "f = 1\nfn f(a) = a\n")
+	assert.EqualError(t, err, "function f on line 2 has the same name as an attribute")
+}
+
+func TestFunctionRegistry(t *testing.T) {
+	registry := NewFunctionRegistry()
+	err := registry.Register(Function{
+		Name:       "echo",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "times", Type: TypeNumber}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			times, ok := args[1].(int)
+			if !ok {
+				return nil, &ArgumentError{Index: 1, Err: errors.New("times must be an integer")}
+			}
+			return strings.Repeat(args[0].(string), times), nil
+		},
+	})
+	assert.NoError(t, err)
+	err = registry.Register(Function{
+		Name:       "sum",
+		Parameters: []Parameter{{Name: "first", Type: TypeNumber}},
+		Variadic:   &Parameter{Name: "numbers", Type: TypeNumber},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			total := 0
+			for _, arg := range args {
+				total += arg.(int)
+			}
+			return total, nil
+		},
+	})
+	assert.NoError(t, err)
+
+	content := "name = \"ab\"\nrepeated = echo(name, 3)\ntotal = sum(1, 2, 3)\nsingle = sum(4)\nbuiltin = upper(\"a\")\n"
+	file, err := parseTestFile(t, content, WithFunctions(registry))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "ababab", file.Attributes["repeated"].Value)
+	assert.EqualValues(t, 6, file.Attributes["total"].Value)
+	assert.EqualValues(t, 4, file.Attributes["single"].Value)
+	assert.EqualValues(t, "A", file.Attributes["builtin"].Value)
+
+	// Registered functions are only available with the registry
+	_, err = parseTestFile(t, "a = echo(\"a\", 2)\n")
+	assert.EqualError(t, err, "line 1: unknown function echo at column 1 of: echo(\"a\", 2)")
+
+	// Arguments are checked before calling the implementation
+	_, err = parseTestFile(t, "a = sum()\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: function sum expects at least 1 argument, got 0 at column 1 of: sum()")
+	_, err = parseTestFile(t, "a = echo(1, 2)\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: argument str of function echo must be a string, got number at column 6 of: echo(1, 2)")
+	_, err = parseTestFile(t, "a = sum(1, \"2\")\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: argument numbers of function sum must be a number, got string at column 8 of: sum(1, \"2\")")
+	_, err = parseTestFile(t, "a = echo(\"a\", 1.5)\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: function echo: times must be an integer at column 11 of: echo(\"a\", 1.5)")
+
+	// Optional parameters
+	err = registry.Register(Function{
+		Name:       "greet",
+		Parameters: []Parameter{{Name: "name", Type: TypeString}, {Name: "greeting", Type: TypeString, Optional: true}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			greeting := "hello"
+			if len(args) == 2 {
+				greeting = args[1].(string)
+			}
+			return greeting + " " + args[0].(string), nil
+		},
+	})
+	assert.NoError(t, err)
+	file, err = parseTestFile(t, "a = greet(\"bob\")\nb = greet(\"bob\", \"hi\")\n", WithFunctions(registry))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "hello bob", file.Attributes["a"].Value)
+	assert.EqualValues(t, "hi bob", file.Attributes["b"].Value)
+	_, err = parseTestFile(t, "a = greet()\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: function greet expects 1 to 2 arguments, got 0 at column 1 of: greet()")
+	_, err = parseTestFile(t, "m {\n    x = 1\n}\na = lookup(m, \"a\", 1, 2)\n")
+	assert.EqualError(t, err, "line 4: function lookup expects 2 to 3 arguments, got 4 at column 19 of: lookup(m, \"a\", 1, 2)")
+
+	// Panics and results that are not NECL values
+	err = registry.Register(Function{Name: "first", Parameters: []Parameter{{Name: "values", Type: TypeArray}}, Implementation: func(args []interface{}) (interface{}, error) { return args[0].([]interface{})[0], nil }})
+	assert.NoError(t, err)
+	_, err = parseTestFile(t, "a = first([])\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: function first: panic: runtime error: index out of range [0] with length 0 at column 1 of: first([])")
+	err = registry.Register(Function{Name: "names", Implementation: func(args []interface{}) (interface{}, error) { return []string{"a"}, nil }})
+	assert.NoError(t, err)
+	_, err = parseTestFile(t, "a = names()\n", WithFunctions(registry))
+	assert.EqualError(t, err, "line 1: function names returned a []string, which is not a NECL value at column 1 of: names()")
+
+	// Invalid functions
+	err = registry.Register(Function{Name: "my-function", Implementation: func(args []interface{}) (interface{}, error) { return nil, nil }})
+	assert.EqualError(t, err, "invalid function name: \"my-function\"")
+	err = registry.Register(Function{Name: "f", Parameters: []Parameter{{Name: "a", Type: "text"}}, Implementation: func(args []interface{}) (interface{}, error) { return nil, nil }})
+	assert.EqualError(t, err, "unknown type text for parameter a of function f")
+	err = registry.Register(Function{Name: "f", Parameters: []Parameter{{Name: "a", Type: TypeAny, Optional: true}, {Name: "b", Type: TypeAny}}, Implementation: func(args []interface{}) (interface{}, error) { return nil, nil }})
+	assert.EqualError(t, err, "required parameter b of function f comes after an optional parameter")
+}
+
+func TestNestedFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-17-test-nested-functions.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "HELLO WORLD", file.Attributes["nested"].Value)
+	assert.EqualValues(t, 11, file.Attributes["deep"].Value)
+	assert.EqualValues(t, true, file.Attributes["condition"].Value)
+	assert.EqualValues(t, "a, b c-d", file.Attributes["commas"].Value)
+	assert.EqualValues(t, 15, file.Attributes["sum"].Value)
+	assert.EqualValues(t, true, file.Attributes["compare"].Value)
+	assert.EqualValues(t, "yes", file.Attributes["withCall"].Value)
+	assert.EqualValues(t, []interface{}{"HELLO", "x y", 4, "a, b"}, file.Attributes["array"].Array)
+	assert.EqualValues(t, "HELLO, world! Ports: 80 and 443", file.Attributes["message"].Value)
+	assert.EqualValues(t, "${not interpolated} 5", file.Attributes["escaped"].Value)
+	assert.EqualValues(t, "Say hi there", file.Attributes["nestedQuotes"].Value)
+
+	// Errors inside arguments and interpolations point at their column
+	_, err = parseTestFile(t, "a = upper(lower(1))\n")
+	assert.EqualError(t, err, "line 1: argument str of function lower must be a string, got number at column 13 of: upper(lower(1))")
+	_, err = parseTestFile(t, "a = [1]\nb = \"value: ${a}\"\n")
+	assert.EqualError(t, err, "line 2: array values can't be interpolated in a string at column 11 of: \"value: ${a}\"")
+	_, err = parseTestFile(t, "b = \"value: ${a +}\"\n")
+	assert.EqualError(t, err, "line 1: unexpected end of expression at column 14 of: \"value: ${a +}\"")
+}
+
+func TestVariadicFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-18-test-variadic.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "", file.Attributes["noValues"].Value)
+	assert.EqualValues(t, "a", file.Attributes["oneValue"].Value)
+	assert.EqualValues(t, "a b c d", file.Attributes["manyValues"].Value)
+	assert.EqualValues(t, 1, file.Attributes["minimum"].Value)
+	assert.EqualValues(t, 3.0, file.Attributes["maximum"].Value)
+	assert.EqualValues(t, 7, file.Attributes["single"].Value)
+	assert.EqualValues(t, "fallback", file.Attributes["first"].Value)
+	assert.EqualValues(t, true, file.Attributes["allTrue"].Value)
+	assert.EqualValues(t, true, file.Attributes["anyTrue"].Value)
+
+	// Wrong argument counts
+	_, err = parseTestFile(t, "a = min()\n")
+	assert.EqualError(t, err, "line 1: function min expects at least 1 argument, got 0 at column 1 of: min()")
+	_, err = parseTestFile(t, "a = upper(\"a\", \"b\")\n")
+	assert.EqualError(t, err, "line 1: function upper expects 1 argument, got 2 at column 12 of: upper(\"a\", \"b\")")
+	_, err = parseTestFile(t, "a = power(2)\n")
+	assert.EqualError(t, err, "line 1: function power expects 2 arguments, got 1 at column 1 of: power(2)")
+	_, err = parseTestFile(t, "a = coalesce(null, \"\")\n")
+	assert.EqualError(t, err, "line 1: function coalesce: all arguments are null or empty strings at column 1 of: coalesce(null, \"\")")
+}
+
+func TestStringFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-19-test-string-functions.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, []interface{}{"a", "b", "c"}, file.Attributes["parts"].Array)
+	assert.EqualValues(t, "a-b-c", file.Attributes["joined"].Value)
+	assert.EqualValues(t, "1 2.5 true", file.Attributes["joinedNumbers"].Value)
+	assert.EqualValues(t, "a/b/c", file.Attributes["replaced"].Value)
+	assert.EqualValues(t, "spaced", file.Attributes["trimmed"].Value)
+	assert.EqualValues(t, "hi", file.Attributes["trimmedCutset"].Value)
+	assert.EqualValues(t, "name", file.Attributes["withoutPrefix"].Value)
+	assert.EqualValues(t, "file", file.Attributes["withoutSuffix"].Value)
+	assert.EqualValues(t, true, file.Attributes["starts"].Value)
+	assert.EqualValues(t, false, file.Attributes["ends"].Value)
+	assert.EqualValues(t, "world", file.Attributes["middle"].Value)
+	assert.EqualValues(t, "world", file.Attributes["fromEnd"].Value)
+	assert.EqualValues(t, "éll", file.Attributes["unicode"].Value)
+	assert.EqualValues(t, "ababab", file.Attributes["repeated"].Value)
+	assert.EqualValues(t, "Hello Big World", file.Attributes["titled"].Value)
+	assert.EqualValues(t, "single line", file.Attributes["indented"].Value)
+	assert.EqualValues(t, "007", file.Attributes["left"].Value)
+	assert.EqualValues(t, "ab  ", file.Attributes["right"].Value)
+
+	// Strings in a file can't have line breaks, but values from applications can
+	indent, ok := NewFunctionRegistry().lookup("indent")
+	assert.True(t, ok)
+	indented, err := indent.Implementation([]interface{}{"first\nsecond\nthird", 2})
+	assert.NoError(t, err)
+	assert.EqualValues(t, "first\n  second\n  third", indented)
+
+	// Invalid arguments
+	_, err = parseTestFile(t, "a = substr(\"abc\", 5, 1)\n")
+	assert.EqualError(t, err, "line 1: function substr: offset 5 is out of range for a string of length 3 at column 1 of: substr(\"abc\", 5, 1)")
+	_, err = parseTestFile(t, "a = repeat(\"a\", -1)\n")
+	assert.EqualError(t, err, "line 1: function repeat: count can't be negative, got -1 at column 1 of: repeat(\"a\", -1)")
+	_, err = parseTestFile(t, "a = repeat(\"a\", 1.5)\n")
+	assert.EqualError(t, err, "line 1: function repeat: count must be an integer, got 1.5 at column 1 of: repeat(\"a\", 1.5)")
+	_, err = parseTestFile(t, "a = join([[1]], \",\")\n")
+	assert.EqualError(t, err, "line 1: function join: element 0 is a array, only strings, numbers and booleans can be joined at column 1 of: join([[1]], \",\")")
+	_, err = parseTestFile(t, "a = trim(\"a\", \"b\", \"c\")\n")
+	assert.EqualError(t, err, "line 1: function trim expects 1 to 2 arguments, got 3 at column 16 of: trim(\"a\", \"b\", \"c\")")
+}
+
+func TestRegexFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-20-test-regex.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "api", file.Attributes["prefix"].Value)
+	assert.EqualValues(t, []interface{}{"api", "7"}, file.Attributes["hostParts"].Array)
+	assert.EqualValues(t, map[string]interface{}{"repository": "registry.local/app", "tag": "1.4.2"}, file.Attributes["imageParts"].Value)
+	assert.EqualValues(t, []interface{}{"1", nil}, file.Attributes["optional"].Array)
+	assert.EqualValues(t, []interface{}{"1", "22", "333"}, file.Attributes["numbers"].Array)
+	assert.EqualValues(t, []interface{}{[]interface{}{"a", "1"}, []interface{}{"b", "2"}}, file.Attributes["pairs"].Array)
+	assert.EqualValues(t, []interface{}{}, file.Attributes["noMatches"].Array)
+	assert.EqualValues(t, "api_7_example_com", file.Attributes["dashed"].Value)
+	assert.EqualValues(t, "value=key", file.Attributes["swapped"].Value)
+	assert.EqualValues(t, true, file.Attributes["validHost"].Value)
+	assert.EqualValues(t, false, file.Attributes["validTag"].Value)
+
+	// Invalid patterns point at the pattern
+	_, err = parseTestFile(t, "a = matches(\"abc\", \"(a\")\n")
+	assert.EqualError(t, err, "line 1: function matches: invalid pattern \"(a\": missing closing ) at column 16 of: matches(\"abc\", \"(a\")")
+	_, err = parseTestFile(t, "a = regex(\"abc\", \"(?P<x>a)(b)\")\n")
+	assert.EqualError(t, err, "line 1: function regex: invalid pattern \"(?P<x>a)(b)\": named and unnamed capture groups can't be mixed at column 14 of: regex(\"abc\", \"(?P<x>a)(b)\")")
+	_, err = parseTestFile(t, "a = if false ? matches(\"abc\", \"[a\") : true\n")
+	assert.EqualError(t, err, "line 1: function matches: invalid pattern \"[a\": missing closing ] at column 27 of: if false ? matches(\"abc\", \"[a\") : true")
+	_, err = parseTestFile(t, "p = \"(a\"\na = regexall(\"abc\", p)\n")
+	assert.EqualError(t, err, "line 2: function regexall: invalid pattern \"(a\": missing closing ) at column 17 of: regexall(\"abc\", p)")
+	_, err = parseTestFile(t, "a = regex(\"abc\", \"\\d\")\n")
+	assert.EqualError(t, err, "line 1: function regex: pattern \"\\\\d\" doesn't match \"abc\" at column 1 of: regex(\"abc\", \"\\d\")")
+}
+
+func TestFormatFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-21-test-format.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "web-007", file.Attributes["id"].Value)
+	assert.EqualValues(t, "50% of web", file.Attributes["percent"].Value)
+	assert.EqualValues(t, "3.14|   2.0|ab  |", file.Attributes["precision"].Value)
+	assert.EqualValues(t, "web 1.5 true \"web\" ff", file.Attributes["mixed"].Value)
+	assert.EqualValues(t, "no verbs", file.Attributes["plain"].Value)
+	assert.EqualValues(t, []interface{}{"web-1.example.com", "web-2.example.com", "web-3.example.com"}, file.Attributes["hosts"].Array)
+	assert.EqualValues(t, []interface{}{"a=1", "b=2"}, file.Attributes["pairs"].Array)
+
+	// Mismatched verbs and values are errors
+	_, err = parseTestFile(t, "a = format(\"%d\", \"x\")\n")
+	assert.EqualError(t, err, "line 1: function format: verb %d can't format a string at column 14 of: format(\"%d\", \"x\")")
+	_, err = parseTestFile(t, "a = format(\"%d\", 1.5)\n")
+	assert.EqualError(t, err, "line 1: function format: verb %d can't format a number at column 14 of: format(\"%d\", 1.5)")
+	_, err = parseTestFile(t, "a = format(\"%s %s\", \"x\")\n")
+	assert.EqualError(t, err, "line 1: function format: verb %s has no value, only 1 given at column 8 of: format(\"%s %s\", \"x\")")
+	_, err = parseTestFile(t, "a = format(\"%s\", \"x\", \"y\")\n")
+	assert.EqualError(t, err, "line 1: function format: too many values, the format uses 1 of 2 at column 19 of: format(\"%s\", \"x\", \"y\")")
+	_, err = parseTestFile(t, "a = format(\"%y\", 1)\n")
+	assert.EqualError(t, err, "line 1: function format: unknown verb %y at column 8 of: format(\"%y\", 1)")
+	_, err = parseTestFile(t, "a = formatlist(\"%s\", [1, 2], [3])\n")
+	assert.EqualError(t, err, "line 1: function formatlist: all arrays must have the same length, expected 2 elements, got 1 at column 26 of: formatlist(\"%s\", [1, 2], [3])")
+	_, err = parseTestFile(t, "a = formatlist(\"%t\", [true, 1])\n")
+	assert.EqualError(t, err, "line 1: function formatlist: element 1: verb %t can't format a number at column 18 of: formatlist(\"%t\", [true, 1])")
+}
+
+func TestCollectionFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-22-test-collections.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, 2, file.Attributes["portCount"].Value)
+	assert.EqualValues(t, 4, file.Attributes["nameCount"].Value)
+	assert.EqualValues(t, 6, file.Attributes["cityLength"].Value)
+	assert.EqualValues(t, "h", file.Attributes["lastLetter"].Value)
+	assert.EqualValues(t, true, file.Attributes["hasA"].Value)
+	assert.EqualValues(t, false, file.Attributes["hasZ"].Value)
+	assert.EqualValues(t, []interface{}{"http", "https"}, file.Attributes["portNames"].Array)
+	assert.EqualValues(t, []interface{}{80, 443}, file.Attributes["portNumbers"].Array)
+	assert.EqualValues(t, map[string]interface{}{"replicas": 3, "region": "eu"}, file.Attributes["settings"].Value)
+	assert.EqualValues(t, []interface{}{1, 2, 3, 4}, file.Attributes["flat"].Array)
+	assert.EqualValues(t, []interface{}{"b", "a", "c"}, file.Attributes["unique"].Array)
+	assert.EqualValues(t, []interface{}{"a", "a", "b", "c"}, file.Attributes["sorted"].Array)
+	assert.EqualValues(t, []interface{}{1, 2.5, 10}, file.Attributes["sortedNumbers"].Array)
+	assert.EqualValues(t, []interface{}{"a", "c", "a", "b"}, file.Attributes["reversed"].Array)
+	assert.EqualValues(t, []interface{}{"a", "c"}, file.Attributes["middle"].Array)
+	assert.EqualValues(t, "a", file.Attributes["wrapped"].Value)
+	assert.EqualValues(t, 2, file.Attributes["position"].Value)
+	assert.EqualValues(t, 80, file.Attributes["found"].Value)
+	assert.EqualValues(t, 21, file.Attributes["missing"].Value)
+	assert.EqualValues(t, map[string]interface{}{"x": 1, "y": 2}, file.Attributes["zipped"].Value)
+	assert.EqualValues(t, []interface{}{[]interface{}{"a", 1}, []interface{}{"a", 2}, []interface{}{"b", 1}, []interface{}{"b", 2}}, file.Attributes["product"].Array)
+	assert.EqualValues(t, []interface{}{[]interface{}{1, 2}, []interface{}{3, 4}, []interface{}{5}}, file.Attributes["chunks"].Array)
+
+	// Invalid collections and arguments
+	_, err = parseTestFile(t, "a = length(1)\n")
+	assert.EqualError(t, err, "line 1: function length: can't get the length of a number at column 8 of: length(1)")
+	_, err = parseTestFile(t, "a = sort([1, \"a\"])\n")
+	assert.EqualError(t, err, "line 1: function sort: only arrays of strings or of numbers can be sorted, element 1 is a string at column 1 of: sort([1, \"a\"])")
+	_, err = parseTestFile(t, "a = slice([1, 2], 1, 3)\n")
+	assert.EqualError(t, err, "line 1: function slice: end 3 out of range for start 1 and length 2 at column 18 of: slice([1, 2], 1, 3)")
+	_, err = parseTestFile(t, "a = index([1, 2], 3)\n")
+	assert.EqualError(t, err, "line 1: function index: value 3 is not in the array at column 15 of: index([1, 2], 3)")
+	_, err = parseTestFile(t, "a = zipmap([\"a\"], [1, 2])\n")
+	assert.EqualError(t, err, "line 1: function zipmap: got 1 keys and 2 values at column 15 of: zipmap([\"a\"], [1, 2])")
+	_, err = parseTestFile(t, "a = chunklist([1], 0)\n")
+	assert.EqualError(t, err, "line 1: function chunklist: size must be positive, got 0 at column 16 of: chunklist([1], 0)")
+	_, err = parseTestFile(t, "block {\na = 1\n}\nb = lookup(block, \"c\")\n")
+	assert.EqualError(t, err, "line 4: function lookup: no key \"c\" in the map and no default value at column 15 of: lookup(block, \"c\")")
+}
+
+func TestMathFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-23-test-math.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, 7, file.Attributes["absInteger"].Value)
+	assert.EqualValues(t, 1.25, file.Attributes["absFloat"].Value)
+	assert.EqualValues(t, 3, file.Attributes["ceiling"].Value)
+	assert.EqualValues(t, -3, file.Attributes["flooring"].Value)
+	assert.EqualValues(t, 3, file.Attributes["rounded"].Value)
+	assert.EqualValues(t, -7, file.Attributes["roundedInteger"].Value)
+	assert.Equal(t, 4, file.Attributes["squareRoot"].Value)
+	assert.InDelta(t, 1.4142, file.Attributes["irrationalRoot"].Value, 0.0001)
+	assert.Equal(t, 0, file.Attributes["natural"].Value)
+	assert.Equal(t, 3, file.Attributes["binary"].Value)
+	assert.Equal(t, 3, file.Attributes["decimal"].Value)
+	assert.InDelta(t, 3.3219, file.Attributes["inexactLog"].Value, 0.0001)
+	assert.EqualValues(t, 9, file.Attributes["squared"].Value)
+	assert.EqualValues(t, 2.0, file.Attributes["fractional"].Value)
+	assert.EqualValues(t, 0.5, file.Attributes["inverse"].Value)
+	assert.InDelta(t, 1.4142, file.Attributes["legacyPower"].Value, 0.0001)
+	assert.EqualValues(t, -1, file.Attributes["hugeExponent"].Value)
+	assert.EqualValues(t, math.MinInt, file.Attributes["largestPower"].Value)
+	assert.EqualValues(t, 1.5, file.Attributes["floatRemainder"].Value)
+	assert.Equal(t, math.MaxInt, file.Attributes["largestSum"].Value)
+	assert.EqualValues(t, 0, file.Attributes["clampedLow"].Value)
+	assert.EqualValues(t, 10, file.Attributes["clampedHigh"].Value)
+	assert.EqualValues(t, 2.5, file.Attributes["unclamped"].Value)
+	assert.EqualValues(t, -7.0, file.Attributes["smallest"].Value)
+	assert.EqualValues(t, 2.5, file.Attributes["largest"].Value)
+
+	// Domain and overflow errors
+	_, err = parseTestFile(t, "a = sqrt(-1)\n")
+	assert.EqualError(t, err, "line 1: function sqrt: can't get the square root of a negative number, got -1 at column 1 of: sqrt(-1)")
+	_, err = parseTestFile(t, "a = log(2, 1)\n")
+	assert.EqualError(t, err, "line 1: function log: the base must be a positive number other than 1, got 1 at column 8 of: log(2, 1)")
+	_, err = parseTestFile(t, "a = log(0)\n")
+	assert.EqualError(t, err, "line 1: function log: the logarithm is only defined for positive numbers, got 0 at column 5 of: log(0)")
+	_, err = parseTestFile(t, "a = pow(-8, 0.5)\n")
+	assert.EqualError(t, err, "line 1: function pow: -8 to the power of 0.5 is not a real number at column 1 of: pow(-8, 0.5)")
+	_, err = parseTestFile(t, "a = pow(10, 19)\n")
+	assert.EqualError(t, err, "line 1: function pow: overflow, 10 to the power of 19 is too large for an integer at column 1 of: pow(10, 19)")
+	_, err = parseTestFile(t, "a = pow(10.0, 400)\n")
+	assert.EqualError(t, err, "line 1: function pow: overflow, 10 to the power of 400 is too large at column 1 of: pow(10.0, 400)")
+	_, err = parseTestFile(t, "a = ceil(pow(10.0, 30))\n")
+	assert.EqualError(t, err, "line 1: function ceil: overflow, 1e+30 is too large for an integer at column 1 of: ceil(pow(10.0, 30))")
+	_, err = parseTestFile(t, "a = 9223372036854775807 + 1\n")
+	assert.EqualError(t, err, "line 1: overflow, 9223372036854775807 + 1 is too large for an integer at column 21 of: 9223372036854775807 + 1")
+	_, err = parseTestFile(t, "a = (-9223372036854775807 - 1) - 1\n")
+	assert.EqualError(t, err, "line 1: overflow, -9223372036854775808 - 1 is too large for an integer at column 28 of: (-9223372036854775807 - 1) - 1")
+	_, err = parseTestFile(t, "a = 4611686018427387904 * 2\n")
+	assert.EqualError(t, err, "line 1: overflow, 4611686018427387904 * 2 is too large for an integer at column 21 of: 4611686018427387904 * 2")
+	_, err = parseTestFile(t, "a = (-9223372036854775807 - 1) / -1\n")
+	assert.EqualError(t, err, "line 1: overflow, -9223372036854775808 / -1 is too large for an integer at column 28 of: (-9223372036854775807 - 1) / -1")
+	_, err = parseTestFile(t, "a = -(-9223372036854775807 - 1)\n")
+	assert.EqualError(t, err, "line 1: overflow, -(-9223372036854775808) is too large for an integer at column 1 of: -(-9223372036854775807 - 1)")
+	_, err = parseTestFile(t, "a = clamp(1, 5, 0)\n")
+	assert.EqualError(t, err, "line 1: function clamp: min 5 is greater than max 0 at column 1 of: clamp(1, 5, 0)")
+}
+
+func TestConversionFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-24-test-conversions.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, 8081, file.Attributes["port"].Value)
+	assert.EqualValues(t, 0.75, file.Attributes["ratio"].Value)
+	assert.EqualValues(t, true, file.Attributes["enabled"].Value)
+	assert.EqualValues(t, "8081", file.Attributes["text"].Value)
+	assert.EqualValues(t, "1.5", file.Attributes["floatText"].Value)
+	assert.EqualValues(t, "false", file.Attributes["boolText"].Value)
+	assert.EqualValues(t, "port 8081", file.Attributes["interpolated"].Value)
+	assert.Nil(t, file.Attributes["nothing"].Value)
+	assert.EqualValues(t, []interface{}{"a"}, file.Attributes["single"].Array)
+	assert.EqualValues(t, []interface{}{1, 2}, file.Attributes["same"].Array)
+	assert.EqualValues(t, []interface{}{}, file.Attributes["empty"].Array)
+	assert.EqualValues(t, map[string]interface{}{"app": "web"}, file.Attributes["labelMap"].Value)
+	assert.EqualValues(t, []interface{}{"string", "number", "number", "boolean", "array", "map", "null"}, file.Attributes["types"].Array)
+
+	// Values that can't be converted
+	_, err = parseTestFile(t, "a = tonumber(\"80a\")\n")
+	assert.EqualError(t, err, "line 1: function tonumber: can't convert \"80a\" to a number at column 1 of: tonumber(\"80a\")")
+	_, err = parseTestFile(t, "a = tonumber(true)\n")
+	assert.EqualError(t, err, "line 1: function tonumber: can't convert a boolean to a number at column 1 of: tonumber(true)")
+	_, err = parseTestFile(t, "a = tobool(\"yes\")\n")
+	assert.EqualError(t, err, "line 1: function tobool: can't convert \"yes\" to a boolean, only \"true\" and \"false\" can at column 1 of: tobool(\"yes\")")
+	_, err = parseTestFile(t, "a = tostring([1])\n")
+	assert.EqualError(t, err, "line 1: function tostring: can't convert a array to a string at column 1 of: tostring([1])")
+	_, err = parseTestFile(t, "a = tomap(\"a\")\n")
+	assert.EqualError(t, err, "line 1: function tomap: can't convert a string to a map at column 1 of: tomap(\"a\")")
+}
+
+func TestEncodingFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-25-test-encoding.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "aHVudGVyMg==", file.Attributes["encodedSecret"].Value)
+	assert.EqualValues(t, "hunter2", file.Attributes["decodedSecret"].Value)
+	assert.EqualValues(t, map[string]interface{}{"version": 1, "actions": []interface{}{"read", "write"}, "ratio": 0.5, "extra": nil}, file.Attributes["decodedPolicy"].Value)
+	assert.EqualValues(t, 1, file.Attributes["policyVersion"].Value)
+	assert.EqualValues(t, `{"actions":["read","write"],"extra":null,"ratio":0.5,"version":1}`, file.Attributes["encodedPolicy"].Value)
+	assert.EqualValues(t, `[1,"two",true]`, file.Attributes["encodedList"].Value)
+	assert.EqualValues(t, map[string]interface{}{"name": "web", "ports": []interface{}{80, 443}}, file.Attributes["fromYaml"].Value)
+	assert.EqualValues(t, "- 80\n- 443\n", file.Attributes["toYaml"].Value)
+	assert.EqualValues(t, "a+b%26c%3Dd%2F%C3%A9", file.Attributes["query"].Value)
+
+	// Strings in a file can't have line breaks, but values from applications and files can
+	csvdecode, ok := NewFunctionRegistry().lookup("csvdecode")
+	assert.True(t, ok)
+	rows, err := csvdecode.Implementation([]interface{}{"name,port\nweb,80\ndb,5432\n"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []interface{}{map[string]interface{}{"name": "web", "port": "80"}, map[string]interface{}{"name": "db", "port": "5432"}}, rows)
+	_, err = csvdecode.Implementation([]interface{}{"name,port\nweb\n"})
+	assert.EqualError(t, err, "invalid CSV: record on line 2: wrong number of fields")
+
+	// Invalid encoded values
+	_, err = parseTestFile(t, "a = base64decode(\"%%\")\n")
+	assert.EqualError(t, err, "line 1: function base64decode: invalid base64: illegal base64 data at input byte 0 at column 1 of: base64decode(\"%%\")")
+	_, err = parseTestFile(t, "a = jsondecode('{\"a\": }')\n")
+	assert.EqualError(t, err, "line 1: function jsondecode: invalid JSON: invalid character '}' looking for beginning of value at column 1 of: jsondecode('{\"a\": }')")
+	_, err = parseTestFile(t, "a = yamldecode(\"[a\")\n")
+	assert.EqualError(t, err, "line 1: function yamldecode: invalid YAML: line 1: did not find expected ',' or ']' at column 1 of: yamldecode(\"[a\")")
+}
+
+func TestHashFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-26-test-hashes.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "5d41402abc4b2a76b9719d911017c592", file.Attributes["md5Hash"].Value)
+	assert.EqualValues(t, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", file.Attributes["sha1Hash"].Value)
+	assert.EqualValues(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", file.Attributes["sha256Hash"].Value)
+	assert.EqualValues(t, "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043", file.Attributes["sha512Hash"].Value)
+	assert.EqualValues(t, "88aab3ede8d3adf94d26ab90d3bafd4a2083070c3bcce9c014ee04a443847c0b", file.Attributes["signature"].Value)
+	assert.EqualValues(t, "3610a686", file.Attributes["checksum"].Value)
+	assert.EqualValues(t, "cfbff0d1-9375-5685-968c-48ce8b15ae17", file.Attributes["dnsID"].Value)
+	assert.EqualValues(t, "d2c1fd4f-f7ca-54d4-baa2-7ffe4ed9f6ae", file.Attributes["customID"].Value)
+	assert.EqualValues(t, true, file.Attributes["sameID"].Value)
+
+	_, err = parseTestFile(t, "a = uuidv5(\"web\", \"a\")\n")
+	assert.EqualError(t, err, "line 1: function uuidv5: namespace must be dns, url, oid, x500 or a UUID, got \"web\" at column 8 of: uuidv5(\"web\", \"a\")")
+}
+
+func TestFileFunctions(t *testing.T) {
+	file, err := ParseNECLFile("./test_data/example-27-test-files.necl")
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n", file.Attributes["certificate"].Value)
+	assert.EqualValues(t, true, file.Attributes["hasCertificate"].Value)
+	assert.EqualValues(t, false, file.Attributes["hasKey"].Value)
+	assert.EqualValues(t, false, file.Attributes["isDirectory"].Value)
+	assert.EqualValues(t, []interface{}{"001-users.sql", "002-orders.sql"}, file.Attributes["migrations"].Array)
+	assert.EqualValues(t, []interface{}{"migrations/001-users.sql", "migrations/002-orders.sql", "migrations/README.md"}, file.Attributes["allFiles"].Array)
+	assert.EqualValues(t, "Q1JFQVRFIFRBQkxFIHVzZXJzIChpZCBJTlQpOwo=", file.Attributes["encoded"].Value)
+	assert.EqualValues(t, "Hello, WEB!\nPorts: 80, 443\n", file.Attributes["greeting"].Value)
+
+	// Files can be restricted to a directory
+	_, err = ParseNECLFile("./test_data/example-27-test-files.necl", WithAllowedRoot("./test_data/files"))
+	assert.NoError(t, err)
+	_, err = ParseNECLFile("./test_data/example-27-test-files.necl", WithAllowedRoot("./test_data/files/migrations"))
+	assert.ErrorContains(t, err, "is outside of the allowed root ./test_data/files/migrations")
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("first line\nsecond ${missing}\n"), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "test.necl"), []byte("a = file(\"../outside.txt\")\n"), 0600)
+	assert.NoError(t, err)
+
+	_, err = ParseNECLFile(filepath.Join(dir, "test.necl"), WithAllowedRoot(dir))
+	assert.EqualError(t, err, fmt.Sprintf("line 1: function file: path %s is outside of the allowed root %s at column 1 of: file(\"../outside.txt\")", filepath.Join(filepath.Dir(dir), "outside.txt"), dir))
+
+	err = os.WriteFile(filepath.Join(dir, "test.necl"), []byte("vars {\n}\nb = templatefile(\"broken.tmpl\", vars)\n"), 0600)
+	assert.NoError(t, err)
+	_, err = ParseNECLFile(filepath.Join(dir, "test.necl"), WithAllowedRoot(dir))
+	assert.EqualError(t, err, "line 3: function templatefile: template broken.tmpl: no attribute named missing was found at line 2, column 10 of: second ${missing} at column 1 of: templatefile(\"broken.tmpl\", vars)")
+
+	_, err = parseTestFile(t, "c = file(\"missing.txt\")\n")
+	assert.EqualError(t, err, "line 1: function file: can't read missing.txt: no such file or directory at column 1 of: file(\"missing.txt\")")
+
+	// Without an allowed root only the directory of the parsed file can be read
+	_, err = parseTestFile(t, "d = file(\"/etc/passwd\")\n")
+	assert.ErrorContains(t, err, "line 1: function file: path /etc/passwd is outside of the allowed root")
+
+	// Expressions evaluated without a parsed file can't read files
+	_, _, err = StringFunctions("file(\"/etc/passwd\")", nil)
+	assert.EqualError(t, err, "function file: path /etc/passwd can't be read, files can only be read while parsing a file at column 1 of: file(\"/etc/passwd\")")
+	_, err = LogicFunctions("fileexists(\"/etc/passwd\")", nil)
+	assert.EqualError(t, err, "function fileexists: path /etc/passwd can't be read, files can only be read while parsing a file at column 1 of: fileexists(\"/etc/passwd\")")
+}
+
+func TestEnvFunction(t *testing.T) {
+	env := map[string]string{"REGION": "eu-west-1", "HOST": "api.local"}
+	file, err := ParseNECLFile("./test_data/example-28-test-env.necl", WithEnv(env))
+	assert.NoError(t, err)
+
+	assert.EqualValues(t, "eu-west-1", file.Attributes["region"].Value)
+	assert.EqualValues(t, 8080, file.Attributes["port"].Value)
+	assert.EqualValues(t, 1, file.Attributes["replicas"].Value)
+	assert.EqualValues(t, "https://api.local:8080", file.Attributes["url"].Value)
+
+	// Without a fake environment the allowed variables of the process are read
+	t.Setenv("NECL_TEST_REGION", "us-east-1")
+	file, err = parseTestFile(t, "region = env(\"NECL_TEST_REGION\")\n", WithAllowedEnv("NECL_TEST_REGION"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "us-east-1", file.Attributes["region"].Value)
+
+	// No variable of the process can be read without an allow-list
+	_, err = parseTestFile(t, "home = env(\"HOME\")\n")
+	assert.EqualError(t, err, "line 1: function env: environment variable HOME is not allowed at column 5 of: env(\"HOME\")")
+	_, _, err = StringFunctions("env(\"HOME\", \"none\")", nil)
+	assert.EqualError(t, err, "function env: environment variable HOME is not allowed at column 5 of: env(\"HOME\", \"none\")")
+
+	// Variables can be allow-listed
+	_, err = ParseNECLFile("./test_data/example-28-test-env.necl", WithEnv(env), WithAllowedEnv("REGION", "PORT", "REPLICAS"))
+	assert.EqualError(t, err, "line 4: function env: environment variable HOST is not allowed at column 16 of: \"https://${env(\"HOST\")}:${port}\"")
+	_, err = parseTestFile(t, "a = env(\"NECL_TEST_REGION\", \"eu\")\n", WithAllowedEnv())
+	assert.EqualError(t, err, "line 1: function env: environment variable NECL_TEST_REGION is not allowed at column 5 of: env(\"NECL_TEST_REGION\", \"eu\")")
+	_, err = parseTestFile(t, "a = env(\"MISSING\")\n", WithEnv(nil))
+	assert.EqualError(t, err, "line 1: function env: environment variable MISSING is not set and has no default value at column 1 of: env(\"MISSING\")")
+}
@@ -0,0 +1,150 @@
+package necl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+)
+
+// registerRegexFunctions adds the functions that work with RE2 regular expressions
+func registerRegexFunctions(r *FunctionRegistry) {
+	r.mustRegister(Function{
+		Name:       "regex",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "pattern", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			expression, err := compilePattern(args[1].(string), 1)
+			if err != nil {
+				return nil, err
+			}
+			str := args[0].(string)
+			match := expression.FindStringSubmatchIndex(str)
+			if match == nil {
+				err := fmt.Errorf("pattern %q doesn't match %q", args[1], str)
+				return nil, err
+			}
+			return regexMatch(expression, str, match), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "regexall",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "pattern", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			expression, err := compilePattern(args[1].(string), 1)
+			if err != nil {
+				return nil, err
+			}
+			str := args[0].(string)
+			matches := []interface{}{}
+			for _, match := range expression.FindAllStringSubmatchIndex(str, -1) {
+				matches = append(matches, regexMatch(expression, str, match))
+			}
+			return matches, nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "regex_replace",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "pattern", Type: TypeString}, {Name: "replacement", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			expression, err := compilePattern(args[1].(string), 1)
+			if err != nil {
+				return nil, err
+			}
+			return expression.ReplaceAllString(args[0].(string), args[2].(string)), nil
+		},
+	})
+	r.mustRegister(Function{
+		Name:       "matches",
+		Parameters: []Parameter{{Name: "str", Type: TypeString}, {Name: "pattern", Type: TypeString}},
+		Implementation: func(args []interface{}) (interface{}, error) {
+			expression, err := compilePattern(args[1].(string), 1)
+			if err != nil {
+				return nil, err
+			}
+			return expression.MatchString(args[0].(string)), nil
+		},
+	})
+}
+
+// Index of the pattern argument of the regex functions
+var patternArguments = map[string]int{
+	"regex":         1,
+	"regexall":      1,
+	"regex_replace": 1,
+	"matches":       1,
+}
+
+// checkPattern compiles the pattern of a call to a regex function when it's written as a string, so invalid patterns
+// are reported when the expression is parsed, even if the call is never evaluated
+func (p *expressionParser) checkPattern(call *callNode) error {
+	index, ok := patternArguments[call.Name]
+	if !ok || index >= len(call.Arguments) {
+		return nil
+	}
+	literal, ok := call.Arguments[index].(*literalNode)
+	if !ok {
+		return nil
+	}
+	pattern, ok := literal.Value.(string)
+	if !ok {
+		return nil
+	}
+
+	_, err := compilePattern(pattern, index)
+	if err != nil {
+		return positionError(p.expression, literal.Pos, "function %s: %s", call.Name, err)
+	}
+	return nil
+}
+
+// compilePattern compiles the pattern given as the argument at index
+// Patterns can't mix named and unnamed capture groups, as the groups are returned either as a map or as an array
+func compilePattern(pattern string, index int) (*regexp.Regexp, error) {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		var syntaxError *syntax.Error
+		if errors.As(err, &syntaxError) {
+			err = fmt.Errorf("invalid pattern %q: %s", pattern, syntaxError.Code)
+		}
+		return nil, &ArgumentError{Index: index, Err: err}
+	}
+
+	named := 0
+	for _, name := range expression.SubexpNames()[1:] {
+		if name != "" {
+			named++
+		}
+	}
+	if named > 0 && named < expression.NumSubexp() {
+		err := fmt.Errorf("invalid pattern %q: named and unnamed capture groups can't be mixed", pattern)
+		return nil, &ArgumentError{Index: index, Err: err}
+	}
+	return expression, nil
+}
+
+// regexMatch gets the value of a match
+// It is the matched text without capture groups, an array of the groups or a map of the named groups
+// Groups that didn't take part in the match are null
+func regexMatch(expression *regexp.Regexp, str string, match []int) interface{} {
+	if expression.NumSubexp() == 0 {
+		return str[match[0]:match[1]]
+	}
+
+	groups := []interface{}{}
+	named := map[string]interface{}{}
+	for i, name := range expression.SubexpNames()[1:] {
+		var group interface{}
+		if start := match[2*(i+1)]; start >= 0 {
+			group = str[start:match[2*(i+1)+1]]
+		}
+		groups = append(groups, group)
+		if name != "" {
+			named[name] = group
+		}
+	}
+
+	if len(named) > 0 {
+		return named
+	}
+	return groups
+}
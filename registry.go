@@ -0,0 +1,279 @@
+package necl
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Types of the parameters of a function
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeArray   = "array"
+	TypeMap     = "map"
+	TypeAny     = "any"
+)
+
+// Functions used when an expression is evaluated without a registry
+// It's created by init since evaluating templates may use it
+var defaultFunctions *FunctionRegistry
+
+func init() {
+	defaultFunctions = NewFunctionRegistry()
+}
+
+// Parameter is a parameter of a function, Type is one of the Type constants
+// Optional parameters can be omitted by calls, they must come after the required ones
+type Parameter struct {
+	Name     string
+	Type     string
+	Optional bool
+}
+
+// Function is a function that can be called from a NECL expression
+// Implementation receives one argument per parameter given by the call, followed by the arguments of the variadic parameter if there is one
+// Omitted optional parameters are not in the arguments, so the number of arguments tells which ones were given
+// Arguments and results are NECL values: string, int, float64, bool, nil, []interface{} or map[string]interface{}
+// Numbers can be an int or a float64, so an implementation must check which one it got
+// Panics of an implementation and results that are not NECL values are returned as errors of the call
+type Function struct {
+	Name           string
+	Parameters     []Parameter
+	Variadic       *Parameter
+	Implementation func(args []interface{}) (interface{}, error)
+}
+
+// ArgumentError can be returned by an implementation when one argument is invalid, the error then points at that argument
+// Index is the position of the argument in the call, starting at 0
+type ArgumentError struct {
+	Index int
+	Err   error
+}
+
+// Error describes why the argument is invalid
+func (e *ArgumentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap gets the error that made the argument invalid
+func (e *ArgumentError) Unwrap() error {
+	return e.Err
+}
+
+// FunctionRegistry has the functions that can be called while parsing a file
+type FunctionRegistry struct {
+	functions map[string]Function
+	// Names of the built-in functions that depend on the settings of a parse, they are bound to them by forParse
+	parseFunctions map[string]bool
+}
+
+// NewFunctionRegistry creates a registry with all built-in functions
+func NewFunctionRegistry() *FunctionRegistry {
+	r := &FunctionRegistry{
+		functions:      make(map[string]Function),
+		parseFunctions: make(map[string]bool),
+	}
+	registerBuiltinFunctions(r)
+
+	return r
+}
+
+// Register adds a function to the registry, replacing any function with the same name
+func (r *FunctionRegistry) Register(function Function) error {
+	tokens, err := tokenize(function.Name)
+	if err != nil || len(tokens) != 2 || tokens[0].Type != tokenIdentifier || isKeyword(function.Name) {
+		err := fmt.Errorf("invalid function name: %q", function.Name)
+		return err
+	}
+	if function.Implementation == nil {
+		err := fmt.Errorf("function %s has no implementation", function.Name)
+		return err
+	}
+
+	parameters := append([]Parameter{}, function.Parameters...)
+	if function.Variadic != nil {
+		parameters = append(parameters, *function.Variadic)
+	}
+	for _, parameter := range parameters {
+		if !isParameterType(parameter.Type) {
+			err := fmt.Errorf("unknown type %s for parameter %s of function %s", parameter.Type, parameter.Name, function.Name)
+			return err
+		}
+	}
+	for i, parameter := range function.Parameters {
+		if !parameter.Optional && i > 0 && function.Parameters[i-1].Optional {
+			err := fmt.Errorf("required parameter %s of function %s comes after an optional parameter", parameter.Name, function.Name)
+			return err
+		}
+	}
+
+	r.functions[function.Name] = function
+	delete(r.parseFunctions, function.Name)
+	return nil
+}
+
+// lookup gets a function by its name
+func (r *FunctionRegistry) lookup(name string) (Function, bool) {
+	function, ok := r.functions[name]
+	return function, ok
+}
+
+// mustRegister adds a built-in function to the registry, built-ins are always valid
+func (r *FunctionRegistry) mustRegister(function Function) {
+	err := r.Register(function)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// clone copies a registry, so functions can be added to the copy without changing the original
+func (r *FunctionRegistry) clone() *FunctionRegistry {
+	c := &FunctionRegistry{
+		functions:      make(map[string]Function, len(r.functions)),
+		parseFunctions: make(map[string]bool, len(r.parseFunctions)),
+	}
+	for name, function := range r.functions {
+		c.functions[name] = function
+	}
+	for name := range r.parseFunctions {
+		c.parseFunctions[name] = true
+	}
+	return c
+}
+
+// isParameterType checks if a type can be used by a parameter
+func isParameterType(parameterType string) bool {
+	switch parameterType {
+	case TypeString, TypeNumber, TypeBoolean, TypeArray, TypeMap, TypeAny:
+		return true
+	}
+	return false
+}
+
+// functions gets the registry of the expression being evaluated
+func (e *evaluator) functions() *FunctionRegistry {
+	if e.registry != nil {
+		return e.registry
+	}
+	return defaultFunctions
+}
+
+// callRegisteredFunction checks the arguments of a call and calls the implementation of a registered function
+func (e *evaluator) callRegisteredFunction(n *callNode, function Function) (interface{}, error) {
+	count := len(function.Parameters)
+	required := requiredParameters(function)
+	switch {
+	case function.Variadic != nil:
+		if len(n.Arguments) < required {
+			return nil, e.errorf(n, "function %s expects at least %s, got %d", function.Name, argumentCount(required), len(n.Arguments))
+		}
+	case required == count:
+		err := e.checkArgumentCount(n, count)
+		if err != nil {
+			return nil, err
+		}
+	case len(n.Arguments) < required:
+		return nil, e.errorf(n, "function %s expects %d to %s, got %d", function.Name, required, argumentCount(count), len(n.Arguments))
+	case len(n.Arguments) > count:
+		return nil, e.errorf(n.Arguments[count], "function %s expects %d to %s, got %d", function.Name, required, argumentCount(count), len(n.Arguments))
+	}
+
+	var args []interface{}
+	for i, argument := range n.Arguments {
+		value, err := e.evaluate(argument)
+		if err != nil {
+			return nil, err
+		}
+		value = normalizeValue(value)
+
+		parameter := function.Variadic
+		if i < count {
+			parameter = &function.Parameters[i]
+		}
+		if parameter.Type != TypeAny && typeOfValue(value) != parameter.Type {
+			return nil, e.errorf(argument, "argument %s of function %s must be a %s, got %s", parameter.Name, function.Name, parameter.Type, typeOfValue(value))
+		}
+		args = append(args, value)
+	}
+
+	result, err := callImplementation(function, args)
+	if err != nil {
+		var at node = n
+		var argumentError *ArgumentError
+		if errors.As(err, &argumentError) && argumentError.Index >= 0 && argumentError.Index < len(n.Arguments) {
+			at = n.Arguments[argumentError.Index]
+		}
+		return nil, e.errorf(at, "function %s: %s", function.Name, err)
+	}
+	if !isValue(result) {
+		return nil, e.errorf(n, "function %s returned a %s, which is not a NECL value", function.Name, typeOfValue(result))
+	}
+	return result, nil
+}
+
+// callImplementation calls the implementation of a function, a panic is returned as an error
+func callImplementation(function Function, args []interface{}) (result interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return function.Implementation(args)
+}
+
+// isValue checks if a value and all of its elements have one of the types of the NECL spec
+func isValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil, string, int, float64, bool:
+		return true
+	case []interface{}:
+		for _, element := range v {
+			if !isValue(element) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		for _, element := range v {
+			if !isValue(element) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// requiredParameters gets the number of parameters that can't be omitted by a call
+func requiredParameters(function Function) int {
+	required := 0
+	for _, parameter := range function.Parameters {
+		if !parameter.Optional {
+			required++
+		}
+	}
+	return required
+}
+
+// checkArgumentCount checks if a call has exactly the given number of arguments
+// Extra arguments are reported at the first one that is not expected, missing arguments at the call
+func (e *evaluator) checkArgumentCount(n *callNode, count int) error {
+	if len(n.Arguments) == count {
+		return nil
+	}
+
+	var at node = n
+	if len(n.Arguments) > count {
+		at = n.Arguments[count]
+	}
+	return e.errorf(at, "function %s expects %s, got %d", n.Name, argumentCount(count), len(n.Arguments))
+}
+
+// argumentCount describes a number of arguments, e.g. 1 argument or 2 arguments
+func argumentCount(count int) string {
+	if count == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", count)
+}
@@ -0,0 +1,128 @@
+package necl
+
+// Names that always refer to a body instead of an attribute
+var reservedNames = []string{"self", "parent", "root"}
+
+// scope has the names defined inside a body
+// Names are looked up in the innermost scope first, so inner names shadow outer ones
+type scope struct {
+	body       *body
+	parent     *scope
+	attributes map[string]Attribute
+	// Local attributes are only visible by name and are not part of the block
+	locals map[string]Attribute
+	// Values of the attributes and nested blocks, as they are seen by references
+	// Nested blocks share their values map, so it is kept up to date as attributes are evaluated
+	values map[string]interface{}
+	blocks []*scope
+}
+
+// newScope creates the scopes of a body and all of its nested blocks, parent is nil for the root of the document
+// Scopes are indexed by their body so attributes can be evaluated in any order
+func newScope(b *body, parent *scope, scopes map[*body]*scope) *scope {
+	s := &scope{
+		body:       b,
+		parent:     parent,
+		attributes: make(map[string]Attribute),
+		locals:     make(map[string]Attribute),
+		values:     make(map[string]interface{}),
+	}
+	scopes[b] = s
+
+	for _, nested := range b.Blocks {
+		if nested.Template == nil {
+			nestedScope := newScope(nested, s, scopes)
+			s.blocks = append(s.blocks, nestedScope)
+			addBlockValue(s.values, nested.Name, nested.Labels, nestedScope.values)
+		}
+	}
+
+	return s
+}
+
+// setAttribute stores the value of an evaluated attribute
+// Attributes take precedence over blocks with the same name
+func (s *scope) setAttribute(attribute Attribute) {
+	s.attributes[attribute.Name] = attribute
+	s.values[attribute.Name] = attributeToValue(attribute)
+}
+
+// block gets the Block of this scope with all attributes evaluated so far
+func (s *scope) block() Block {
+	return Block{
+		Name:       s.body.Name,
+		Labels:     s.body.Labels,
+		Attributes: s.attributes,
+		Blocks:     s.nestedBlocks(),
+	}
+}
+
+// nestedBlocks gets the blocks defined in this scope, indexed by their name and labels
+func (s *scope) nestedBlocks() map[string]Block {
+	blocks := make(map[string]Block)
+	for _, nested := range s.blocks {
+		blocks[blockKey(nested.body.Name, nested.body.Labels)] = nested.block()
+	}
+	return blocks
+}
+
+// lookupName finds a name visible from this scope, including the self, parent and root bodies
+func (s *scope) lookupName(name string) (Attribute, bool) {
+	// Explicit references to bodies
+	switch name {
+	case "self":
+		return Attribute{Name: name, Type: "map", Value: s.values}, true
+	case "root":
+		root := s
+		for root.parent != nil {
+			root = root.parent
+		}
+		return Attribute{Name: name, Type: "map", Value: root.values}, true
+	case "parent":
+		if s.parent == nil {
+			return Attribute{}, false
+		}
+		return Attribute{Name: name, Type: "map", Value: s.parent.values}, true
+	}
+
+	// Names of this scope shadow the ones of outer scopes
+	for current := s; current != nil; current = current.parent {
+		if attribute, ok := current.ownName(name); ok {
+			return attribute, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// ownName finds a name defined in this scope
+// Loop variables of generated blocks shadow locals, which shadow attributes, blocks and functions of the same block
+func (s *scope) ownName(name string) (Attribute, bool) {
+	if value, ok := s.body.Variables[name]; ok {
+		return valueToAttribute(name, value), true
+	}
+	if attribute, ok := s.locals[name]; ok {
+		return attribute, true
+	}
+	if attribute, ok := s.attributes[name]; ok {
+		return attribute, true
+	}
+	if value, ok := s.values[name]; ok {
+		return Attribute{Name: name, Type: "map", Value: value}, true
+	}
+	for _, function := range s.body.Functions {
+		if function.Name == name {
+			return Attribute{Name: name, Type: "function", Value: function}, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// isReservedName checks if a name can't be used by attributes and blocks
+func isReservedName(name string) bool {
+	for _, reserved := range reservedNames {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
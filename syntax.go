@@ -0,0 +1,762 @@
+package necl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Identifiers that are part of the syntax and never reference an attribute
+var expressionKeywords = []string{"if", "else", "for", "in", "true", "false", "null"}
+
+// node is an element of a parsed expression
+type node interface {
+	Position() int
+}
+
+// literalNode is a constant value written in the expression
+type literalNode struct {
+	Pos   int
+	Value interface{}
+}
+
+// referenceNode is a reference to an attribute by its name
+type referenceNode struct {
+	Pos  int
+	Name string
+}
+
+// arrayNode is an array written in the expression, e.g. [1, 2, 3]
+type arrayNode struct {
+	Pos      int
+	Elements []node
+}
+
+// conditionalNode chooses between two values, e.g. if enabled ? 1 : 0
+type conditionalNode struct {
+	Pos       int
+	Condition node
+	Positive  node
+	Negative  node
+}
+
+// forNode creates an array or a map out of the elements of a collection, e.g. for i, v in list : v * i
+// KeyName and ValueName are the loop variables, Key is only set when creating a map (key => value)
+// and Filter is only set when elements are filtered (: v if v > 0)
+type forNode struct {
+	Pos        int
+	KeyName    string
+	ValueName  string
+	Collection node
+	Key        node
+	Value      node
+	Filter     node
+}
+
+// interpolationNode is a string with expressions inside, e.g. "Hello, ${name}!"
+// Parts are the literal parts of the string and the interpolated expressions, in order
+type interpolationNode struct {
+	Pos   int
+	Parts []node
+}
+
+// callNode calls a function, e.g. upper(name)
+// Source is the call as written in the expression
+type callNode struct {
+	Pos       int
+	Name      string
+	Arguments []node
+	Source    string
+}
+
+// binaryNode applies an operator to two values, e.g. a + b or port in ports
+type binaryNode struct {
+	Pos      int
+	Operator string
+	Left     node
+	Right    node
+}
+
+// unaryNode applies an operator to a single value, e.g. -1 or !enabled
+type unaryNode struct {
+	Pos      int
+	Operator string
+	Operand  node
+}
+
+// indexNode gets a single element of a collection, e.g. ports[0] or labels["app"]
+type indexNode struct {
+	Pos        int
+	Collection node
+	Key        node
+}
+
+// sliceNode gets a part of an array or string, e.g. name[0:3]
+// Low and High are nil when omitted
+type sliceNode struct {
+	Pos        int
+	Collection node
+	Low        node
+	High       node
+}
+
+// getAttributeNode gets an attribute of a block or a value of a map, e.g. metadata.labels
+type getAttributeNode struct {
+	Pos        int
+	Collection node
+	Name       string
+}
+
+// splatNode applies the same traversal to every element of a collection, e.g. backends[*].address
+// A full splat ([*]) applies every following index and attribute operator to each element,
+// an attribute splat (.*) only applies the following attribute operators
+type splatNode struct {
+	Pos        int
+	Collection node
+	Each       node
+	Full       bool
+}
+
+// splatElementNode is the element of the collection that a splat is currently visiting
+type splatElementNode struct {
+	Pos int
+}
+
+// blockTemplate is the header of a block generated once per element of a collection,
+// e.g. for name, server in servers : backend name, or only when a condition is true, e.g. if prod : tls
+// Collection is only set for loops and Condition is only set for conditional blocks
+type blockTemplate struct {
+	Header     string
+	KeyName    string
+	ValueName  string
+	Collection node
+	Condition  node
+	Name       string
+	Labels     []node
+}
+
+func (n *literalNode) Position() int       { return n.Pos }
+func (n *referenceNode) Position() int     { return n.Pos }
+func (n *arrayNode) Position() int         { return n.Pos }
+func (n *conditionalNode) Position() int   { return n.Pos }
+func (n *forNode) Position() int           { return n.Pos }
+func (n *interpolationNode) Position() int { return n.Pos }
+func (n *callNode) Position() int          { return n.Pos }
+func (n *binaryNode) Position() int        { return n.Pos }
+func (n *unaryNode) Position() int         { return n.Pos }
+func (n *indexNode) Position() int         { return n.Pos }
+func (n *sliceNode) Position() int         { return n.Pos }
+func (n *getAttributeNode) Position() int  { return n.Pos }
+func (n *splatNode) Position() int         { return n.Pos }
+func (n *splatElementNode) Position() int  { return n.Pos }
+
+// Binary operators by precedence, from the lowest to the highest
+var binaryOperators = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"in"},
+	{"..", "..="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// expressionParser builds nodes out of the tokens of an expression
+type expressionParser struct {
+	expression string
+	tokens     []token
+	current    int
+}
+
+// parseExpression parses a full expression
+func parseExpression(expression string) (node, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &expressionParser{
+		expression: expression,
+		tokens:     tokens,
+	}
+
+	n, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole expression must be consumed
+	if p.peek().Type != tokenEOF {
+		return nil, p.unexpected(p.peek())
+	}
+
+	return n, nil
+}
+
+// parseTemplate parses a text with interpolations that is not written between quotes, e.g. the content of a template file
+func parseTemplate(text string) (node, error) {
+	p := &expressionParser{
+		expression: text,
+	}
+	// The text starts just after the position of the token, like the text of a string starts after its quote
+	return p.parseInterpolation(token{Type: tokenString, Text: text, Pos: -1})
+}
+
+// peek returns the current token without consuming it
+func (p *expressionParser) peek() token {
+	return p.tokens[p.current]
+}
+
+// next consumes the current token
+func (p *expressionParser) next() token {
+	t := p.tokens[p.current]
+	if t.Type != tokenEOF {
+		p.current++
+	}
+	return t
+}
+
+// isOperator checks if the current token is the given operator
+func (p *expressionParser) isOperator(operator string) bool {
+	t := p.peek()
+	return t.Type == tokenOperator && t.Text == operator
+}
+
+// expect consumes the given operator or fails
+func (p *expressionParser) expect(operator string) (token, error) {
+	if !p.isOperator(operator) {
+		return token{}, p.unexpected(p.peek())
+	}
+	return p.next(), nil
+}
+
+// unexpected creates an error for a token that can't be used where it was found
+func (p *expressionParser) unexpected(t token) error {
+	if t.Type == tokenEOF {
+		return positionError(p.expression, t.Pos, "unexpected end of expression")
+	}
+	return positionError(p.expression, t.Pos, "unexpected %q", t.Text)
+}
+
+// parseConditional parses a full expression, which can be a conditional, e.g. if enabled ? 1 : 0
+// The negative outcome can be written after ":" or "else", so else if chains can be written as
+// if a ? 1 else if b ? 2 else 3
+func (p *expressionParser) parseConditional() (node, error) {
+	if p.isKeyword("for") {
+		return p.parseFor()
+	}
+	if !p.isKeyword("if") {
+		return p.parseBinary(0)
+	}
+	start := p.next()
+
+	condition, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("?"); err != nil {
+		return nil, err
+	}
+	positive, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.isKeyword("else") {
+		p.next()
+	} else if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	negative, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conditionalNode{Pos: start.Pos, Condition: condition, Positive: positive, Negative: negative}, nil
+}
+
+// parseFor parses a "for" expression
+func (p *expressionParser) parseFor() (node, error) {
+	start := p.next()
+	n := &forNode{Pos: start.Pos}
+
+	keyName, valueName, err := p.parseLoopVariables()
+	if err != nil {
+		return nil, err
+	}
+	n.KeyName = keyName
+	n.ValueName = valueName
+
+	// Collection
+	collection, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	n.Collection = collection
+	if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	// Outcome, with a key when creating a map
+	outcome, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOperator("=>") {
+		p.next()
+		n.Key = outcome
+		outcome, err = p.parseConditional()
+		if err != nil {
+			return nil, err
+		}
+	}
+	n.Value = outcome
+
+	// Filter
+	if p.isKeyword("if") {
+		p.next()
+		n.Filter, err = p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// parseBlockTemplate parses the header of a generated or conditional block
+// Labels can be any value, e.g. for server in servers : backend server.name "http"
+func parseBlockTemplate(header string) (*blockTemplate, error) {
+	tokens, err := tokenize(header)
+	if err != nil {
+		return nil, err
+	}
+	p := &expressionParser{
+		expression: header,
+		tokens:     tokens,
+	}
+	template := &blockTemplate{Header: header}
+
+	// Loop or condition
+	if p.next().Text == "if" {
+		template.Condition, err = p.parseBinary(0)
+	} else {
+		template.KeyName, template.ValueName, err = p.parseLoopVariables()
+		if err == nil {
+			template.Collection, err = p.parseBinary(0)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+
+	// Block name
+	name := p.next()
+	if name.Type != tokenIdentifier || isKeyword(name.Text) {
+		return nil, p.unexpected(name)
+	}
+	template.Name = name.Text
+
+	// Labels
+	for p.peek().Type != tokenEOF {
+		label, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		template.Labels = append(template.Labels, label)
+	}
+
+	return template, nil
+}
+
+// parseInterpolation parses the expressions inside a string, "$${" is a literal "${"
+func (p *expressionParser) parseInterpolation(t token) (node, error) {
+	n := &interpolationNode{Pos: t.Pos}
+
+	// Positions are kept relative to the whole expression
+	offset := t.Pos + 1
+	literal := ""
+	i := 0
+	for i < len(t.Text) {
+		switch {
+		case strings.HasPrefix(t.Text[i:], "$${"):
+			literal += "${"
+			i += 3
+		case strings.HasPrefix(t.Text[i:], "${"):
+			if literal != "" {
+				n.Parts = append(n.Parts, &literalNode{Pos: offset + i, Value: literal})
+				literal = ""
+			}
+			end, err := scanInterpolation(p.expression, offset+i)
+			if err != nil {
+				return nil, err
+			}
+			part, err := p.parseEmbedded(offset+i+2, end-1)
+			if err != nil {
+				return nil, err
+			}
+			n.Parts = append(n.Parts, part)
+			i = end - offset
+		default:
+			literal += t.Text[i : i+1]
+			i++
+		}
+	}
+	if literal != "" {
+		n.Parts = append(n.Parts, &literalNode{Pos: offset + i, Value: literal})
+	}
+
+	return n, nil
+}
+
+// parseEmbedded parses an expression written between two positions of the expression, e.g. inside an interpolation
+func (p *expressionParser) parseEmbedded(start int, end int) (node, error) {
+	tokens, err := tokenize(p.expression[start:end])
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		tokens[i].Pos += start
+	}
+	embedded := &expressionParser{
+		expression: p.expression,
+		tokens:     tokens,
+	}
+
+	n, err := embedded.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if embedded.peek().Type != tokenEOF {
+		return nil, embedded.unexpected(embedded.peek())
+	}
+	return n, nil
+}
+
+// parseLoopVariables parses the names of the variables of a loop, e.g. v in or i, v in
+// Without named variables (for list : value) the loop variables are called index and value
+func (p *expressionParser) parseLoopVariables() (string, string, error) {
+	// The token after an identifier always exists since the last token is the end of the expression
+	first := p.peek()
+	if first.Type != tokenIdentifier || !(isKeywordToken(p.tokens[p.current+1], "in") || isOperatorToken(p.tokens[p.current+1], ",")) {
+		return "index", "value", nil
+	}
+	p.next()
+
+	keyName, valueName := "", first.Text
+	if p.isOperator(",") {
+		p.next()
+		value := p.next()
+		if value.Type != tokenIdentifier || isKeyword(value.Text) {
+			return "", "", p.unexpected(value)
+		}
+		if value.Text == first.Text {
+			return "", "", positionError(p.expression, value.Pos, "loop variables must have different names")
+		}
+		keyName, valueName = first.Text, value.Text
+	}
+	if !p.isKeyword("in") {
+		return "", "", p.unexpected(p.peek())
+	}
+	p.next()
+
+	return keyName, valueName, nil
+}
+
+// isKeyword checks if the current token is the given keyword
+func (p *expressionParser) isKeyword(keyword string) bool {
+	return isKeywordToken(p.peek(), keyword)
+}
+
+// parseBinary parses operations with operators of a certain precedence level or higher
+// Operators of the same level are evaluated from left to right, e.g. 1 - 2 + 3 is (1 - 2) + 3
+func (p *expressionParser) parseBinary(level int) (node, error) {
+	if level == len(binaryOperators) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isBinaryOperator(level) {
+		operator := p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{Pos: operator.Pos, Operator: operator.Text, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+// isBinaryOperator checks if the current token is a binary operator of a certain precedence level
+func (p *expressionParser) isBinaryOperator(level int) bool {
+	t := p.peek()
+	if t.Type != tokenOperator && t.Type != tokenIdentifier {
+		return false
+	}
+	for _, operator := range binaryOperators[level] {
+		if t.Text == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUnary parses a value with an optional sign or negation in front of it
+func (p *expressionParser) parseUnary() (node, error) {
+	if p.isOperator("-") || p.isOperator("!") {
+		operator := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{Pos: operator.Pos, Operator: operator.Text, Operand: operand}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a value followed by any number of index, slice, attribute or splat operators
+func (p *expressionParser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Innermost splat whose elements receive the next operators
+	var splat *splatNode
+
+	for p.isOperator("[") || p.isOperator(".") {
+		open := p.next()
+
+		// Splats, e.g. backends[*] or backends.*
+		full := open.Text == "[" && p.isOperator("*") && p.tokens[p.current+1].Type == tokenOperator && p.tokens[p.current+1].Text == "]"
+		if full || (open.Text == "." && p.isOperator("*")) {
+			p.next()
+			if full {
+				p.next()
+			}
+
+			newSplat := &splatNode{Pos: open.Pos, Each: &splatElementNode{Pos: open.Pos}, Full: full}
+			if splat != nil && (splat.Full || !full) {
+				newSplat.Collection = splat.Each
+				splat.Each = newSplat
+			} else {
+				newSplat.Collection = n
+				n = newSplat
+			}
+			splat = newSplat
+			continue
+		}
+
+		// Attribute or index operator
+		var operator node
+		if open.Text == "." {
+			operator, err = p.parseAttributeOperator()
+		} else {
+			operator, err = p.parseIndexOperator(open)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Attribute splats end at the first index operator
+		if splat != nil && !splat.Full && open.Text == "[" {
+			splat = nil
+		}
+
+		if splat != nil {
+			splat.Each = setCollection(operator, splat.Each)
+		} else {
+			n = setCollection(operator, n)
+		}
+	}
+
+	return n, nil
+}
+
+// parseAttributeOperator parses the name after a ".", e.g. metadata.name
+// Numbers are also names, so numeric labels can be used in dotted references, e.g. backend.node.0
+// The collection of the returned node is set by the caller
+func (p *expressionParser) parseAttributeOperator() (node, error) {
+	name := p.next()
+	if name.Type != tokenIdentifier && name.Type != tokenNumber {
+		return nil, p.unexpected(name)
+	}
+	return &getAttributeNode{Pos: name.Pos, Name: name.Text}, nil
+}
+
+// parseIndexOperator parses an index (e.g. ports[0]) or a slice (e.g. name[0:3]) after the "["
+// The collection of the returned node is set by the caller
+func (p *expressionParser) parseIndexOperator(open token) (node, error) {
+	var err error
+
+	// Low bound or index, omitted on slices like name[:3]
+	var low node
+	if !p.isOperator(":") {
+		low, err = p.parseConditional()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isOperator(":") {
+		p.next()
+
+		// High bound, omitted on slices like name[3:]
+		var high node
+		if !p.isOperator("]") {
+			high, err = p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &sliceNode{Pos: open.Pos, Low: low, High: high}, nil
+	}
+
+	if _, err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	return &indexNode{Pos: open.Pos, Key: low}, nil
+}
+
+// setCollection sets the value an index, slice or attribute operator is applied to
+func setCollection(operator node, collection node) node {
+	switch operator := operator.(type) {
+	case *getAttributeNode:
+		operator.Collection = collection
+	case *indexNode:
+		operator.Collection = collection
+	case *sliceNode:
+		operator.Collection = collection
+	}
+	return operator
+}
+
+// parsePrimary parses literals, references, arrays and parenthesis
+func (p *expressionParser) parsePrimary() (node, error) {
+	t := p.next()
+
+	switch t.Type {
+	case tokenString:
+		if strings.Contains(t.Text, "${") {
+			return p.parseInterpolation(t)
+		}
+		return &literalNode{Pos: t.Pos, Value: t.Text}, nil
+	case tokenNumber:
+		if strings.Contains(t.Text, ".") {
+			value, err := strconv.ParseFloat(t.Text, 32)
+			if err != nil {
+				return nil, positionError(p.expression, t.Pos, "invalid number %s", t.Text)
+			}
+			return &literalNode{Pos: t.Pos, Value: value}, nil
+		}
+		value, err := strconv.Atoi(t.Text)
+		if err != nil {
+			return nil, positionError(p.expression, t.Pos, "invalid number %s", t.Text)
+		}
+		return &literalNode{Pos: t.Pos, Value: value}, nil
+	case tokenIdentifier:
+		switch t.Text {
+		case "true":
+			return &literalNode{Pos: t.Pos, Value: true}, nil
+		case "false":
+			return &literalNode{Pos: t.Pos, Value: false}, nil
+		case "null":
+			return &literalNode{Pos: t.Pos, Value: nil}, nil
+		}
+
+		// Function call
+		if p.isOperator("(") {
+			p.next()
+			call := &callNode{Pos: t.Pos, Name: t.Text}
+			for !p.isOperator(")") {
+				argument, err := p.parseConditional()
+				if err != nil {
+					return nil, err
+				}
+				call.Arguments = append(call.Arguments, argument)
+
+				if !p.isOperator(",") {
+					break
+				}
+				p.next()
+			}
+			end, err := p.expect(")")
+			if err != nil {
+				return nil, err
+			}
+			call.Source = p.expression[t.Pos : end.Pos+1]
+			err = p.checkPattern(call)
+			if err != nil {
+				return nil, err
+			}
+			return call, nil
+		}
+
+		return &referenceNode{Pos: t.Pos, Name: t.Text}, nil
+	case tokenOperator:
+		// Array
+		if t.Text == "[" {
+			array := &arrayNode{Pos: t.Pos}
+			for !p.isOperator("]") {
+				element, err := p.parseConditional()
+				if err != nil {
+					return nil, err
+				}
+				array.Elements = append(array.Elements, element)
+
+				if !p.isOperator(",") {
+					break
+				}
+				p.next()
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return array, nil
+		}
+
+		// Parenthesis
+		if t.Text == "(" {
+			n, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+
+	return nil, p.unexpected(t)
+}
+
+// isOperatorToken checks if a token is a certain operator
+func isOperatorToken(t token, operator string) bool {
+	return t.Type == tokenOperator && t.Text == operator
+}
+
+// isKeywordToken checks if a token is a certain keyword
+func isKeywordToken(t token, keyword string) bool {
+	return t.Type == tokenIdentifier && t.Text == keyword
+}
+
+// isKeyword checks if an identifier is part of the syntax
+func isKeyword(name string) bool {
+	for _, keyword := range expressionKeywords {
+		if name == keyword {
+			return true
+		}
+	}
+	return false
+}
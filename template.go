@@ -0,0 +1,165 @@
+package necl
+
+import (
+	"fmt"
+)
+
+// expandTemplates replaces every generated block of a document with one block per element of its collection,
+// and every conditional block with the block itself or nothing, depending on its condition
+// Templates are expanded from the outermost to the innermost, so nested templates can use the loop variables
+// of the blocks around them
+func expandTemplates(root *body, functions *FunctionRegistry, evaluated map[*attributeDefinition]Attribute) error {
+	for {
+		template := findTemplate(root)
+		if template == nil {
+			return nil
+		}
+
+		blocks, err := expandTemplate(root, template, functions, evaluated)
+		if err != nil {
+			return err
+		}
+
+		// The generated blocks take the place of the template
+		parent := template.Parent
+		var siblings []*body
+		for _, sibling := range parent.Blocks {
+			if sibling != template {
+				siblings = append(siblings, sibling)
+				continue
+			}
+			for _, block := range blocks {
+				err := checkDuplicateBlock(&body{Blocks: siblings}, block)
+				if err != nil {
+					return err
+				}
+				siblings = append(siblings, block)
+			}
+		}
+		parent.Blocks = siblings
+	}
+}
+
+// findTemplate gets the first generated or conditional block of a body that is not inside another template
+func findTemplate(b *body) *body {
+	for _, nested := range b.Blocks {
+		if nested.Template != nil {
+			return nested
+		}
+		if template := findTemplate(nested); template != nil {
+			return template
+		}
+	}
+	return nil
+}
+
+// expandTemplate creates the blocks of a template, one per element of its collection or one if its condition is true
+// The attributes referenced by the header are evaluated first, unless an earlier template already evaluated them,
+// the rest of the document is evaluated once all templates are expanded
+func expandTemplate(root *body, template *body, functions *FunctionRegistry, evaluated map[*attributeDefinition]Attribute) ([]*body, error) {
+	scopes := make(map[*body]*scope)
+	newScope(root, nil, scopes)
+
+	g := newDependencyGraph(root)
+	header := g.addTemplate(template)
+	order, err := g.orderOf([]*attributeDefinition{header})
+	if err != nil {
+		return nil, err
+	}
+	err = evaluateAttributes(order[:len(order)-1], scopes, functions, evaluated)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &evaluator{
+		expression: template.Template.Header,
+		names:      scopes[template.Parent],
+		registry:   functions,
+	}
+	// Variables of each block, conditional blocks create a single block without variables
+	var blockLocals []map[string]interface{}
+	if template.Template.Condition != nil {
+		condition, err := e.evaluate(template.Template.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+		}
+		include, ok := condition.(bool)
+		if !ok {
+			err := e.errorf(template.Template.Condition, "condition must be a boolean, got %s", typeOfValue(condition))
+			return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+		}
+		if include {
+			blockLocals = append(blockLocals, nil)
+		}
+	} else {
+		collection, err := e.evaluate(template.Template.Collection)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+		}
+		keys, elements, ok := collectionElements(collection)
+		if !ok {
+			err := e.errorf(template.Template.Collection, "a 'for' block requires an array or a map, got %s", typeOfValue(collection))
+			return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+		}
+		for i, element := range elements {
+			locals := map[string]interface{}{template.Template.ValueName: element}
+			if template.Template.KeyName != "" {
+				locals[template.Template.KeyName] = keys[i]
+			}
+			blockLocals = append(blockLocals, locals)
+		}
+	}
+
+	var blocks []*body
+	for _, locals := range blockLocals {
+		// Labels
+		var labels []string
+		e.locals = nil
+		if locals != nil {
+			e.locals = []map[string]interface{}{locals}
+		}
+		for _, labelNode := range template.Template.Labels {
+			label, err := e.evaluate(labelNode)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+			}
+			switch label.(type) {
+			case string, int, float64:
+				labels = append(labels, fmt.Sprint(label))
+			default:
+				err := e.errorf(labelNode, "block labels must be strings or numbers, got %s", typeOfValue(label))
+				return nil, fmt.Errorf("line %d: %w", template.Line+1, err)
+			}
+		}
+
+		block := copyBody(template, template.Parent)
+		block.Labels = labels
+		block.Template = nil
+		block.Variables = locals
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// copyBody creates a copy of a body and all of its nested blocks
+func copyBody(b *body, parent *body) *body {
+	c := &body{
+		Name:      b.Name,
+		Labels:    b.Labels,
+		Line:      b.Line,
+		Parent:    parent,
+		Functions: b.Functions,
+		Template:  b.Template,
+		Variables: b.Variables,
+	}
+	for _, definition := range b.Attributes {
+		attribute := *definition
+		attribute.Body = c
+		c.Attributes = append(c.Attributes, &attribute)
+	}
+	for _, nested := range b.Blocks {
+		c.Blocks = append(c.Blocks, copyBody(nested, c))
+	}
+	return c
+}
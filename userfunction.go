@@ -0,0 +1,136 @@
+package necl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Start of the definition of a function, fn followed by a name and its parameters
+var functionDefinition = regexp.MustCompile(`^fn\s+[A-Za-z_]\w*\s*\(`)
+
+// Maximum number of nested calls to functions defined in the document, so recursive functions always end
+const maxCallDepth = 64
+
+// userFunction is a function defined in the document, e.g. fn port_for(i) = 8000 + i * 10
+// Functions are pure, their body can only use their parameters and call other functions
+type userFunction struct {
+	Name       string
+	Parameters []string
+	Body       node
+	Source     string
+	Line       int
+}
+
+// parseFunctionDefinition reads the definition of a function, written as fn name(parameters) = body
+func parseFunctionDefinition(line string, lineNumber int) (*userFunction, error) {
+	tokens, err := tokenize(line)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+	p := &expressionParser{
+		expression: line,
+		tokens:     tokens,
+	}
+
+	// Name
+	p.next()
+	name := p.next()
+	if name.Type != tokenIdentifier || isKeyword(name.Text) || isReservedName(name.Text) {
+		return nil, fmt.Errorf("line %d: invalid function name: %s", lineNumber+1, name.Text)
+	}
+	function := &userFunction{
+		Name: name.Text,
+		Line: lineNumber,
+	}
+
+	// Parameters
+	if _, err := p.expect("("); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+	for !p.isOperator(")") {
+		if len(function.Parameters) > 0 {
+			if _, err := p.expect(","); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+			}
+		}
+		parameter := p.next()
+		if parameter.Type != tokenIdentifier || isKeyword(parameter.Text) || isReservedName(parameter.Text) {
+			return nil, fmt.Errorf("line %d: %w", lineNumber+1, p.unexpected(parameter))
+		}
+		for _, previous := range function.Parameters {
+			if previous == parameter.Text {
+				return nil, fmt.Errorf("line %d: duplicate parameter %s in function %s", lineNumber+1, parameter.Text, function.Name)
+			}
+		}
+		function.Parameters = append(function.Parameters, parameter.Text)
+	}
+	p.next()
+	equals, err := p.expect("=")
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+
+	// Body
+	function.Source = strings.TrimSpace(line[equals.Pos+1:])
+	function.Body, err = parseExpression(function.Source)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+
+	return function, nil
+}
+
+// callFunction evaluates the body of a function defined in the document
+// The body is evaluated in its own scope, with the parameters as the only variables
+func (e *evaluator) callFunction(n *callNode, function *userFunction) (interface{}, error) {
+	err := e.checkArgumentCount(n, len(function.Parameters))
+	if err != nil {
+		return nil, err
+	}
+	if e.depth >= maxCallDepth {
+		return nil, e.errorf(n, "function %s exceeded the maximum call depth of %d", function.Name, maxCallDepth)
+	}
+
+	parameters := make(map[string]interface{})
+	for i, argument := range n.Arguments {
+		value, err := e.evaluate(argument)
+		if err != nil {
+			return nil, err
+		}
+		parameters[function.Parameters[i]] = value
+	}
+
+	// Only functions are visible inside the body
+	body := &evaluator{
+		expression: function.Source,
+		names:      functionNames{names: e.names},
+		registry:   e.registry,
+		locals:     []map[string]interface{}{parameters},
+		depth:      e.depth + 1,
+	}
+	return body.evaluate(function.Body)
+}
+
+// functionNames only finds the functions of other names, attributes aren't visible inside the body of a function
+type functionNames struct {
+	names names
+}
+
+func (f functionNames) lookupName(name string) (Attribute, bool) {
+	attribute, ok := f.names.lookupName(name)
+	if !ok || attribute.Type != "function" {
+		return Attribute{}, false
+	}
+	return attribute, true
+}
+
+// userFunctionOf gets the function defined in the document that a call refers to, if any
+func userFunctionOf(name string, names names) (*userFunction, bool) {
+	attribute, ok := names.lookupName(name)
+	if !ok || attribute.Type != "function" {
+		return nil, false
+	}
+	function, ok := attribute.Value.(*userFunction)
+	return function, ok
+}